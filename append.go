@@ -0,0 +1,137 @@
+package studydiskv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+func (d *Diskv) Append(key string, val []byte) error {
+	return d.AppendStream(key, bytes.NewReader(val), false)
+}
+
+// AppendStream appends what r yields to the value of key, creating the
+// value if needed. Raw values are opened with O_APPEND; values stored with
+// gzip or Snappy get another compressed stream appended. Values in other
+// formats, and files hard linked by Clone or Snapshot, are decoded and
+// rewritten.
+func (d *Diskv) AppendStream(key string, r io.Reader, sync bool) error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(key) <= 0 {
+		return errEmpty
+	}
+
+	pathKey := d.transform(key)
+	if err := d.validateKey(pathKey); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Linked into a snapshot, the file is rewritten rather than appended to.
+	d.preserveWithLock(key)
+	c := d.compressionFor(key)
+	fi, err := d.FileSystem.Stat(d.completeFilename(pathKey))
+	switch {
+	case os.IsNotExist(err):
+		return d.writeStreamWithLock(pathKey, r, c, sync)
+	case err != nil:
+		return err
+	case fi.IsDir():
+		return errBadKey
+	case fi.Size() == 0:
+		return d.writeStreamWithLock(pathKey, r, c, sync)
+	}
+
+	stored, hdr, err := d.storedCodecWithLock(pathKey, c)
+	if err != nil {
+		return err
+	}
+	cc, ok := stored.(concatenable)
+	if (stored != nil && (!ok || !cc.concatenable())) || linkCount(fi) > 1 ||
+		stored == nil && !rawAppendable(hdr) {
+		return d.appendRewriteWithLock(pathKey, r, c, sync)
+	}
+	if err := d.appendInPlaceWithLock(pathKey, fi.Size(), r, stored, sync); err != nil {
+		return err
+	}
+	return d.addedWithLock(pathKey)
+}
+
+// storedCodecWithLock returns the Compression the value at pathKey is
+// stored with, nil if it is raw, and the value's first bytes.
+func (d *Diskv) storedCodecWithLock(pathKey *PathKey, legacy Compression) (Compression, []byte, error) {
+	f, err := openFile(d.FileSystem, d.completeFilename(pathKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, len(codecMagic)+1)
+	n, err := io.ReadFull(f, hdr)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+	c, _, err := valueCodec(hdr[:n], legacy)
+	return c, hdr[:n], err
+}
+
+// rawAppendable reports whether a raw value beginning with hdr can be
+// appended to in place. One stored without a header cannot if it is too
+// short to be told from an encoded value, or begins as codecMagic does:
+// what is appended could complete a header, or a format sniffCodec
+// recognizes.
+func rawAppendable(hdr []byte) bool {
+	if bytes.HasPrefix(hdr, []byte(codecMagic)) {
+		return true // stored with the raw codec's header
+	}
+	return len(hdr) > len(codecMagic) && hdr[0] != codecMagic[0]
+}
+
+func (d *Diskv) appendInPlaceWithLock(pathKey *PathKey, size int64, r io.Reader, c Compression, sync bool) error {
+	f, err := d.FileSystem.OpenFile(d.completeFilename(pathKey), os.O_WRONLY|os.O_APPEND, d.FilePerm)
+	if err != nil {
+		return fmt.Errorf("open file: %s", err)
+	}
+
+	fail := func(format string, err error) error {
+		f.Truncate(size)
+		f.Close()
+		return fmt.Errorf(format, err)
+	}
+
+	wc := io.WriteCloser(&nopWriteCloser{f})
+	if c != nil {
+		if wc, err = c.Writer(f); err != nil {
+			return fail("compression writer: %s", err)
+		}
+	}
+	if _, err := io.Copy(wc, r); err != nil {
+		return fail("i/o copy: %s", err)
+	}
+	if err := wc.Close(); err != nil {
+		return fail("compression close: %s", err)
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			return fail("file sync: %s", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("file close: %s", err)
+	}
+	return nil
+}
+
+func (d *Diskv) appendRewriteWithLock(pathKey *PathKey, r io.Reader, c Compression, sync bool) error {
+	rc, err := d.readValue(pathKey, c, nil)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return d.writeStreamWithLock(pathKey, io.MultiReader(rc, r), c, sync)
+}
@@ -0,0 +1,111 @@
+package studydiskv
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	codecs := []Compression{nil, NewGzipCompression(), NewSnappyCompression(), NewZlibCompression(), NewSeekableCompression(8)}
+	for i, c := range codecs {
+		d := New(Options{
+			BasePath:     "test-append",
+			CacheSizeMax: 1024,
+			Compression:  c,
+			Index:        &BTreeIndex{},
+			IndexLess:    strLess,
+		})
+
+		if err := d.Append("log", []byte("one\n")); err != nil {
+			t.Fatalf("codec #%d: %s", i, err)
+		}
+		if have := d.ReadString("log"); have != "one\n" {
+			t.Errorf("codec #%d: want %q, have %q", i, "one\n", have)
+		}
+		if !d.isCache("log") {
+			t.Errorf("codec #%d: not cached after read", i)
+		}
+
+		for _, line := range []string{"two\n", "three\n"} {
+			if err := d.AppendStream("log", strings.NewReader(line), true); err != nil {
+				t.Fatalf("codec #%d: %s", i, err)
+			}
+		}
+		if d.isCache("log") {
+			t.Errorf("codec #%d: still cached after append", i)
+		}
+		if want, have := "one\ntwo\nthree\n", d.ReadString("log"); have != want {
+			t.Errorf("codec #%d: want %q, have %q", i, want, have)
+		}
+		if !d.isIndexed("log") {
+			t.Errorf("codec #%d: not indexed", i)
+		}
+		d.EraseAll()
+	}
+}
+
+func TestAppendInPlace(t *testing.T) {
+	d := New(Options{
+		BasePath:    "test-append",
+		Compression: NewGzipCompression(),
+	})
+	defer d.EraseAll()
+
+	d.WriteString("log", "one\n")
+	filename := d.completeFilename(d.transform("log"))
+	before, _ := os.Stat(filename)
+
+	if err := d.Append("log", []byte("two\n")); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(filename)
+	if !os.SameFile(before, after) {
+		t.Errorf("gzip value rewritten instead of appended to")
+	}
+	if have := storedCodec(t, d, "log"); have != fmt.Sprint(gzipCodecID) {
+		t.Errorf("stored with codec %s after append", have)
+	}
+}
+
+func TestAppendRawLooksEncoded(t *testing.T) {
+	d := New(Options{BasePath: "test-append", FileSystem: NewMemFS()})
+	for _, parts := range [][]string{
+		{"\x89d", "kv\x03hello"},  // completes codecMagic
+		{"\x89", "dkv\x00", "x"},  // completes the raw codec's header
+		{"\x1f", "\x8b\x08 gzip"}, // looks gzipped
+		{"ab", "cdef", "gh"},      // plain, short at first
+	} {
+		d.Erase("log")
+		for _, part := range parts {
+			if err := d.Append("log", []byte(part)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := strings.Join(parts, "")
+		if have, err := d.Read("log"); err != nil || string(have) != want {
+			t.Errorf("want %q, have %q, %v", want, have, err)
+		}
+	}
+}
+
+func TestAppendSecondary(t *testing.T) {
+	d := New(Options{
+		BasePath: "test-append",
+	})
+	defer d.EraseAll()
+
+	d.RegisterSecondaryIndex("words", func(key string, val []byte) []string {
+		return []string{string(val)}
+	})
+	d.WriteString("a", "x")
+	d.AppendStream("a", strings.NewReader("y"), false)
+
+	if have, _ := d.Lookup("words", "xy"); len(have) != 1 {
+		t.Errorf("appended value not indexed, have %v", have)
+	}
+	if have, _ := d.Lookup("words", "x"); len(have) != 0 {
+		t.Errorf("stale term still indexed, have %v", have)
+	}
+}
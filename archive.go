@@ -0,0 +1,152 @@
+package studydiskv
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ArchiveProgress is told the key just exported or imported, and how many
+// values and bytes of them have been done so far.
+type ArchiveProgress func(key string, keys int, bytes int64)
+
+// Export writes the values of the keys beginning with prefix to w as a tar
+// stream. Entries are named by key and hold the decompressed value, so the
+// archive does not depend on the store's transform or compression. Values
+// whose size only decoding tells are decoded once, into a temporary file
+// in the host's temporary directory, and copied from there.
+func (d *Diskv) Export(ctx context.Context, w io.Writer, prefix string) error {
+	tw := tar.NewWriter(w)
+	keys, total := 0, int64(0)
+	for key, err := range d.KeysSeq(prefix) {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := d.exportKey(tw, key)
+		if os.IsNotExist(err) {
+			continue // erased since it was listed
+		}
+		if err != nil {
+			return fmt.Errorf("export %s: %s", key, err)
+		}
+		keys, total = keys+1, total+n
+		if d.ArchiveProgress != nil {
+			d.ArchiveProgress(key, keys, total)
+		}
+	}
+	return tw.Close()
+}
+
+func (d *Diskv) exportKey(tw *tar.Writer, key string) (int64, error) {
+	h, err := d.Open(key)
+	if err != nil {
+		return 0, err
+	}
+	defer h.Close()
+
+	var r io.Reader = h
+	var size int64
+	if _, ok := h.v.(*streamValue); ok {
+		tmp, err := ioutil.TempFile("", stagingPrefix+"export-")
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if size, err = io.Copy(tmp, h); err != nil {
+			return 0, err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		r = tmp
+	} else if size, err = h.Size(); err != nil {
+		return 0, err
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     key,
+		Size:     size,
+		Mode:     int64(defaultFilePerm),
+		ModTime:  time.Unix(0, 0),
+	}
+	if d.ArchiveMetadata {
+		fi, err := h.f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		hdr.Mode, hdr.ModTime = int64(fi.Mode().Perm()), fi.ModTime()
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return 0, err
+	}
+	return io.Copy(tw, r)
+}
+
+// ImportArchive writes every value in the tar stream r, as made by Export,
+// into the store. Values are compressed as the store's options say.
+func (d *Diskv) ImportArchive(ctx context.Context, r io.Reader) error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
+	tr := tar.NewReader(r)
+	keys, total := 0, int64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("archive: %s", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err := d.importEntry(hdr, tr); err != nil {
+			return fmt.Errorf("import %s: %s", hdr.Name, err)
+		}
+		keys, total = keys+1, total+hdr.Size
+		if d.ArchiveProgress != nil {
+			d.ArchiveProgress(hdr.Name, keys, total)
+		}
+	}
+}
+
+func (d *Diskv) importEntry(hdr *tar.Header, r io.Reader) error {
+	key := hdr.Name
+	if key == "" {
+		return errEmpty
+	}
+	pathKey := d.transform(key)
+	if err := d.validateKey(pathKey); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.writeStreamWithLock(pathKey, r, d.compressionFor(key), false); err != nil {
+		return err
+	}
+	if !d.ArchiveMetadata || hdr.ModTime.Unix() == 0 {
+		return nil // no metadata to restore
+	}
+	filename := d.completeFilename(pathKey)
+	if err := d.FileSystem.Chtimes(filename, hdr.ModTime, hdr.ModTime); err != nil {
+		return err
+	}
+	return d.FileSystem.Chmod(filename, os.FileMode(hdr.Mode).Perm())
+}
@@ -0,0 +1,153 @@
+package studydiskv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExportImportArchive(t *testing.T) {
+	src := New(Options{
+		BasePath:          "test-export-src",
+		AdvancedTransform: hashTransform,
+		InverseTransform:  hashInverseTransform,
+		Compression:       NewGzipCompression(),
+		ArchiveMetadata:   true,
+	})
+	defer src.EraseAll()
+	dst := New(Options{
+		BasePath:        "test-export-dst",
+		Compression:     NewSnappyCompression(),
+		ArchiveMetadata: true,
+	})
+	defer dst.EraseAll()
+
+	want := map[string]string{"a1": "one", "a2": "two", "b1": "three"}
+	for k, v := range want {
+		if err := src.WriteString(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(src.completeFilename(src.transform("a1")), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Export(context.Background(), &buf, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	var progress []string
+	var bytesDone int64
+	dst.ArchiveProgress = func(key string, keys int, n int64) {
+		progress = append(progress, key)
+		bytesDone = n
+	}
+	if err := dst.ImportArchive(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := collectKeys(t, dst, ""); !cmpStrings(keys, []string{"a1", "a2"}) {
+		t.Errorf("keys: have %v", keys)
+	}
+	if !cmpStrings(progress, []string{"a1", "a2"}) || bytesDone != 6 {
+		t.Errorf("progress: have %v, %d bytes", progress, bytesDone)
+	}
+	for _, k := range []string{"a1", "a2"} {
+		if have := dst.ReadString(k); have != want[k] {
+			t.Errorf("%s: want %q, have %q", k, want[k], have)
+		}
+		if c := storedCodec(t, dst, k); c != fmt.Sprint(snappyCodecID) {
+			t.Errorf("%s: stored with codec %s", k, c)
+		}
+	}
+	fi, err := os.Stat(dst.completeFilename(dst.transform("a1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("mtime: want %s, have %s", mtime, fi.ModTime())
+	}
+}
+
+// readCountFS counts the bytes read from the files it opens.
+type readCountFS struct {
+	FS
+	n int64
+}
+
+func (fsys *readCountFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fsys.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountFile{File: f, n: &fsys.n}, nil
+}
+
+type readCountFile struct {
+	File
+	n *int64
+}
+
+func (f *readCountFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	*f.n += int64(n)
+	return n, err
+}
+
+func (f *readCountFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	*f.n += int64(n)
+	return n, err
+}
+
+func TestExportDecodesOnce(t *testing.T) {
+	val := make([]byte, 1<<16)
+	rand.New(rand.NewSource(1)).Read(val)
+	for _, c := range []Compression{NewGzipCompression(), NewSnappyCompression(), NewNoCompression()} {
+		fsys := &readCountFS{FS: NewMemFS()}
+		d := New(Options{BasePath: "test-export-once", FileSystem: fsys, Compression: c})
+		if err := d.Write("k", val); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := fsys.Stat(d.completeFilename(d.transform("k")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fsys.n = 0
+		var buf bytes.Buffer
+		if err := d.Export(context.Background(), &buf, ""); err != nil {
+			t.Fatal(err)
+		}
+		if fsys.n > fi.Size()+int64(len(codecMagic))+1 {
+			t.Errorf("codec %d: read %d bytes of a %d-byte file", c.(Codec).CodecID(), fsys.n, fi.Size())
+		}
+
+		dst := New(Options{BasePath: "test-export-once", FileSystem: NewMemFS()})
+		if err := dst.ImportArchive(context.Background(), &buf); err != nil {
+			t.Fatal(err)
+		}
+		if have, err := dst.Read("k"); err != nil || !cmpByte(have, val) {
+			t.Errorf("codec %d: value not exported whole (err = %v)", c.(Codec).CodecID(), err)
+		}
+	}
+}
+
+func TestExportCanceled(t *testing.T) {
+	d := New(Options{BasePath: "test-export-cancel"})
+	defer d.EraseAll()
+	d.WriteString("k", "v")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var buf bytes.Buffer
+	if err := d.Export(ctx, &buf, ""); err != context.Canceled {
+		t.Errorf("want %v, have %v", context.Canceled, err)
+	}
+}
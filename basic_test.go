@@ -92,7 +92,7 @@ func TestString(t *testing.T) {
 	v := []byte{'1'}
 	for k := range keys {
 		if err := d.Write(k, v); err != nil {
-			t.Fatal("write: %s: %s", k, err)
+			t.Fatalf("write: %s: %s", k, err)
 		}
 	}
 
@@ -0,0 +1,309 @@
+package studydiskv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultClientRetries   = 3
+	defaultClientRetryWait = 100 * time.Millisecond
+	clientListLimit        = 1000
+	// Long enough for a slow disk, short enough to notice a hung server.
+	defaultClientHeaderTimeout = 30 * time.Second
+)
+
+// defaultHTTPClient waits defaultClientHeaderTimeout for response headers.
+// It sets no overall timeout, which would cut off long streams.
+var defaultHTTPClient = newHTTPClient(defaultClientHeaderTimeout)
+
+func newHTTPClient(headerTimeout time.Duration) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = headerTimeout
+	return &http.Client{Transport: t}
+}
+
+// Client is a Store backed by a store served with NewHandler.
+type Client struct {
+	// BaseURL is where the handler is served, without the /keys path.
+	BaseURL string
+	// HTTPClient makes the requests. NewClient sets one that gives up on
+	// a server that sends no response headers within 30 seconds; nil
+	// means the same.
+	HTTPClient *http.Client
+	// Retries is how many times a request failing on the network or with
+	// a 5xx status is retried, waiting RetryWait and then twice as long
+	// each time.
+	Retries   int
+	RetryWait time.Duration
+}
+
+var _ Store = (*Client)(nil)
+
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		HTTPClient: defaultHTTPClient,
+		Retries:    defaultClientRetries,
+		RetryWait:  defaultClientRetryWait,
+	}
+}
+
+func (c *Client) Read(key string) ([]byte, error) {
+	rc, err := c.ReadStream(key, false)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// ReadStream streams the value of key. If the connection fails part way,
+// the rest is requested again with a Range request, provided the value has
+// not changed since. direct is ignored: the Client does not cache.
+func (c *Client) ReadStream(key string, direct bool) (io.ReadCloser, error) {
+	resp, err := c.do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &resumingReader{c: c, key: key, etag: resp.Header.Get("ETag"), body: resp.Body}, nil
+}
+
+func (c *Client) Write(key string, val []byte) error {
+	return c.WriteStream(key, bytes.NewReader(val), false)
+}
+
+// WriteStream uploads what r yields as the value of key. Failed uploads
+// are only retried when r is an io.Seeker that can be rewound.
+func (c *Client) WriteStream(key string, r io.Reader, sync bool) error {
+	q := url.Values{}
+	if sync {
+		q.Set("sync", "1")
+	}
+	resp, err := c.do("PUT", key, q, nil, r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) Erase(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) Has(key string) bool {
+	resp, err := c.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+func (c *Client) Keys(cancel <-chan struct{}) <-chan string {
+	return c.KeysPrefix("", cancel)
+}
+
+// KeysPrefix lists keys page by page as they are consumed. The channel is
+// closed early if a page cannot be fetched.
+func (c *Client) KeysPrefix(prefix string, cancel <-chan struct{}) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		after := ""
+		for {
+			list, err := c.list(prefix, after)
+			if err != nil {
+				return
+			}
+			for _, key := range list.Keys {
+				select {
+				case ch <- key:
+				case <-cancel:
+					return
+				}
+			}
+			if list.Next == "" {
+				return
+			}
+			after = list.Next
+		}
+	}()
+	return ch
+}
+
+func (c *Client) list(prefix, after string) (*KeyList, error) {
+	q := url.Values{}
+	q.Set("prefix", prefix)
+	q.Set("after", after)
+	q.Set("limit", strconv.Itoa(clientListLimit))
+	resp, err := c.do("GET", "", q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	list := &KeyList{}
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, fmt.Errorf("list: %s", err)
+	}
+	return list, nil
+}
+
+// do sends a request for key, or for the key list if key is empty, and
+// returns the response if it succeeded.
+func (c *Client) do(method, key string, q url.Values, hdr http.Header, body io.Reader) (*http.Response, error) {
+	u := c.BaseURL + "/keys"
+	if key != "" {
+		u += "/" + url.PathEscape(key)
+	}
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	seeker, rewindable := body.(io.Seeker)
+	if body == nil {
+		rewindable = true
+	}
+	var start int64
+	if seeker != nil {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			rewindable = false
+		}
+	}
+
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			time.Sleep(wait)
+			wait *= 2
+			if seeker != nil {
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		resp, err := c.send(method, u, hdr, body)
+		retry := rewindable && attempt < c.Retries
+		if err != nil {
+			if retry {
+				continue
+			}
+			return nil, err
+		}
+		if resp.StatusCode >= 500 && retry {
+			resp.Body.Close()
+			continue
+		}
+		if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotModified {
+			return nil, c.statusError(method, key, resp)
+		}
+		return resp, nil
+	}
+}
+
+func (c *Client) send(method, u string, hdr http.Header, body io.Reader) (*http.Response, error) {
+	if body != nil {
+		// Keep the transport from closing a body the caller still owns.
+		body = ioutil.NopCloser(body)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	return client.Do(req)
+}
+
+func (c *Client) statusError(method, key string, resp *http.Response) error {
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return &os.PathError{Op: method, Path: key, Err: os.ErrNotExist}
+	case http.StatusPreconditionFailed:
+		return errPrecondition
+	case http.StatusForbidden:
+		return ErrReadOnly
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s %s: %s: %s", method, key, resp.Status, bytes.TrimSpace(msg))
+}
+
+// resumingReader reads a value from the Client, resuming after failed
+// reads with Range requests conditional on the value's ETag.
+type resumingReader struct {
+	c       *Client
+	key     string
+	etag    string
+	body    io.ReadCloser
+	n       int64
+	resumes int
+	err     error
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.body.Read(p)
+	r.n += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if r.etag == "" || r.resumes >= r.c.Retries {
+		r.err = err
+		return n, err
+	}
+
+	r.resumes++
+	r.body.Close()
+	if r.err = r.resume(); r.err != nil {
+		return n, r.err
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return r.Read(p)
+}
+
+func (r *resumingReader) resume() error {
+	hdr := http.Header{}
+	hdr.Set("Range", fmt.Sprintf("bytes=%d-", r.n))
+	hdr.Set("If-Range", r.etag)
+	resp, err := r.c.do("GET", r.key, nil, hdr, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		// The value changed; what was already read is stale.
+		resp.Body.Close()
+		return fmt.Errorf("%s changed while being read", r.key)
+	}
+	r.body = resp.Body
+	return nil
+}
+
+func (r *resumingReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,162 @@
+package studydiskv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, s Store) {
+	if err := s.Write("k1", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteStream("k2", strings.NewReader("two"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write("other", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := s.Read("k1"); err != nil || string(val) != "one" {
+		t.Errorf("Read: have %q, %v", val, err)
+	}
+	rc, err := s.ReadStream("k2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(val) != "two" {
+		t.Errorf("ReadStream: have %q, %v", val, err)
+	}
+	if !s.Has("k1") || s.Has("missing") {
+		t.Errorf("Has: wrong answers")
+	}
+
+	keys := []string{}
+	for key := range s.KeysPrefix("k", nil) {
+		keys = append(keys, key)
+	}
+	if !cmpStrings(keys, []string{"k1", "k2"}) {
+		t.Errorf("KeysPrefix: have %v", keys)
+	}
+	n := 0
+	for range s.Keys(nil) {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("Keys: want 3, have %d", n)
+	}
+
+	if err := s.Erase("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Read("k1"); !os.IsNotExist(err) {
+		t.Errorf("Read after Erase: have %v", err)
+	}
+	if err := s.Erase("k1"); !os.IsNotExist(err) {
+		t.Errorf("Erase twice: have %v", err)
+	}
+}
+
+func TestStoreDiskv(t *testing.T) {
+	d := New(Options{BasePath: "test-store-diskv"})
+	defer d.EraseAll()
+	testStore(t, d)
+}
+
+func TestStoreClient(t *testing.T) {
+	d := New(Options{BasePath: "test-store-client", Compression: NewSnappyCompression()})
+	defer d.EraseAll()
+	srv := httptest.NewServer(NewHandler(d))
+	defer srv.Close()
+	testStore(t, NewClient(srv.URL))
+}
+
+func TestClientRetry(t *testing.T) {
+	d := New(Options{BasePath: "test-client-retry"})
+	defer d.EraseAll()
+	h := NewHandler(d)
+
+	var failures int32 = 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL)
+	c.RetryWait = time.Millisecond
+	if err := c.Write("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if d.ReadString("k") != "v" {
+		t.Errorf("value not stored")
+	}
+
+	// A body that cannot be rewound is not retried.
+	atomic.StoreInt32(&failures, 1)
+	if err := c.WriteStream("k", ioutil.NopCloser(strings.NewReader("w")), false); err == nil {
+		t.Errorf("want error, have none")
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	if NewClient(srv.URL).HTTPClient.Transport.(*http.Transport).ResponseHeaderTimeout == 0 {
+		t.Errorf("default client waits forever for a response")
+	}
+	c := NewClient(srv.URL)
+	c.HTTPClient = newHTTPClient(10 * time.Millisecond)
+	c.Retries = 0
+	if _, err := c.Read("k"); err == nil {
+		t.Errorf("want error, have none")
+	}
+}
+
+func TestClientResume(t *testing.T) {
+	d := New(Options{BasePath: "test-client-resume", Compression: NewSeekableCompression(1024)})
+	defer d.EraseAll()
+	val := bytes.Repeat([]byte("0123456789"), 1000)
+	d.Write("k", val)
+	h := NewHandler(d)
+
+	var cut int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" && atomic.AddInt32(&cut, -1) == 0 {
+			// Promise the whole value, send part of it.
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			w.Header().Set("ETag", rec.Header().Get("ETag"))
+			w.Header().Set("Content-Length", strconv.Itoa(rec.Body.Len()))
+			w.Write(rec.Body.Bytes()[:rec.Body.Len()/3])
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	have, err := NewClient(srv.URL).Read("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, val) {
+		t.Errorf("resumed read: have %d bytes, want %d", len(have), len(val))
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"studydiskv"
+	"time"
+)
+
+var errUsage = errors.New("wrong number of arguments")
+
+func get(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	d, err := openReadOnly()
+	if err != nil {
+		return err
+	}
+	rc, err := d.ReadStream(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(os.Stdout, rc)
+	return err
+}
+
+func put(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	d, err := open()
+	if err != nil {
+		return err
+	}
+	r := io.Reader(os.Stdin)
+	if len(args) == 2 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	return d.WriteStream(args[0], r, true)
+}
+
+func rm(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	d, err := open()
+	if err != nil {
+		return err
+	}
+	for _, key := range args {
+		if err := d.Erase(key); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+func ls(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	index := fs.Bool("index", false, "list through an in-memory Index rather than by walking")
+	long := fs.Bool("l", false, "show codec and sizes")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return errUsage
+	}
+
+	o, err := options()
+	if err != nil {
+		return err
+	}
+	o.ReadOnly = true
+	if *index {
+		o.Index = &studydiskv.BTreeIndex{}
+		o.IndexLess = func(a, b string) bool { return a < b }
+	}
+	d := studydiskv.New(o)
+
+	for key, err := range d.KeysSeq(fs.Arg(0)) {
+		if err != nil {
+			return err
+		}
+		if !*long {
+			fmt.Println(key)
+			continue
+		}
+		info, err := d.Stat(key)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		fmt.Printf("%-9s %10d %10d  %s\n", info.Codec, info.StoredSize, info.Size, key)
+	}
+	return nil
+}
+
+func stat(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	d, err := openReadOnly()
+	if err != nil {
+		return err
+	}
+	for _, key := range args {
+		info, err := d.Stat(key)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		fmt.Printf("key:      %s\n", info.Key)
+		fmt.Printf("path:     %s\n", info.Path)
+		fmt.Printf("codec:    %s\n", info.Codec)
+		fmt.Printf("stored:   %d\n", info.StoredSize)
+		fmt.Printf("size:     %d\n", info.Size)
+		fmt.Printf("modified: %s\n", info.ModTime.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func importCmd(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	move := fs.Bool("move", false, "move files rather than copy them")
+	archive := fs.Bool("archive", false, "path is a tar archive made by export, or - for stdin")
+	metadata := fs.Bool("metadata", false, "restore modification times and modes from the archive")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errUsage
+	}
+
+	o, err := options()
+	if err != nil {
+		return err
+	}
+	o.ArchiveMetadata = *metadata
+	d := studydiskv.New(o)
+	path := fs.Arg(0)
+
+	if *archive {
+		r := io.Reader(os.Stdin)
+		if path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		return d.ImportArchive(context.Background(), r)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if fs.NArg() == 2 {
+			return errors.New("a key cannot be given for a directory")
+		}
+		return d.ImportDir(path, nil, *move)
+	}
+	key := filepath.Base(path)
+	if fs.NArg() == 2 {
+		key = fs.Arg(1)
+	}
+	return d.Import(path, key, *move)
+}
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "-", "archive to write, - for stdout")
+	metadata := fs.Bool("metadata", false, "record modification times and modes")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return errUsage
+	}
+
+	o, err := options()
+	if err != nil {
+		return err
+	}
+	o.ReadOnly = true
+	o.ArchiveMetadata = *metadata
+	d := studydiskv.New(o)
+
+	if *out == "-" {
+		return d.Export(context.Background(), os.Stdout, fs.Arg(0))
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := d.Export(context.Background(), f, fs.Arg(0)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// fsck reads every value through, reporting those that do not decode.
+func fsck(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	d, err := openReadOnly()
+	if err != nil {
+		return err
+	}
+
+	keys, bad := 0, 0
+	for key, err := range d.KeysSeq(firstArg(args)) {
+		if err != nil {
+			return err
+		}
+		keys++
+		if err := readThrough(d, key); err != nil {
+			fmt.Printf("%s: %s\n", key, err)
+			bad++
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d values unreadable", bad, keys)
+	}
+	fmt.Printf("%d values ok\n", keys)
+	return nil
+}
+
+func readThrough(d *studydiskv.Diskv, key string) error {
+	rc, err := d.ReadStream(key, true)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
+
+func du(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	d, err := openReadOnly()
+	if err != nil {
+		return err
+	}
+
+	var keys, stored, size int64
+	for key, err := range d.KeysSeq(firstArg(args)) {
+		if err != nil {
+			return err
+		}
+		info, err := d.Stat(key)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		keys, stored, size = keys+1, stored+info.StoredSize, size+info.Size
+	}
+	ratio := 1.0
+	if size > 0 {
+		ratio = float64(stored) / float64(size)
+	}
+	fmt.Printf("keys:   %d\nstored: %d\nsize:   %d\nratio:  %.3f\n", keys, stored, size, ratio)
+	return nil
+}
+
+// bench times writes, reads and erases in a scratch store configured like
+// the real one, without a cache.
+func bench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	n := fs.Int("n", 1000, "number of values")
+	size := fs.Int("size", 4096, "bytes per value")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	o, err := options()
+	if err != nil {
+		return err
+	}
+	o.ReadOnly = false
+	if o.BasePath, err = os.MkdirTemp("", "diskv-bench"); err != nil {
+		return err
+	}
+	defer os.RemoveAll(o.BasePath)
+	d := studydiskv.New(o)
+
+	// Text-like values: a small alphabet, so codecs have something to do.
+	val := make([]byte, *size)
+	for i := range val {
+		val[i] = byte('a' + rand.Intn(8))
+	}
+	keys := make([]string, *n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("bench-%08d", i)
+	}
+
+	report := func(op string, start time.Time) {
+		elapsed := time.Since(start)
+		mb := float64(*n) * float64(*size) / (1 << 20)
+		fmt.Printf("%-6s %8.0f ops/s %8.1f MB/s\n", op, float64(*n)/elapsed.Seconds(), mb/elapsed.Seconds())
+	}
+
+	start := time.Now()
+	for _, key := range keys {
+		if err := d.Write(key, val); err != nil {
+			return err
+		}
+	}
+	report("write", start)
+
+	start = time.Now()
+	for _, key := range keys {
+		if err := readThrough(d, key); err != nil {
+			return err
+		}
+	}
+	report("read", start)
+
+	start = time.Now()
+	for _, key := range keys {
+		if err := d.Erase(key); err != nil {
+			return err
+		}
+	}
+	report("erase", start)
+	return nil
+}
+
+// serve runs studydiskv.NewHandler over the store.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	index := fs.Bool("index", false, "keep an in-memory Index for listings")
+	cache := fs.Uint64("cache", 0, "bytes of values to cache")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	o, err := options()
+	if err != nil {
+		return err
+	}
+	if *index {
+		o.Index = &studydiskv.BTreeIndex{}
+		o.IndexLess = func(a, b string) bool { return a < b }
+	}
+	o.CacheSizeMax = *cache
+	d := studydiskv.New(o)
+
+	fmt.Fprintf(os.Stderr, "serving %s on %s\n", o.BasePath, *addr)
+	return http.ListenAndServe(*addr, studydiskv.NewHandler(d))
+}
+
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
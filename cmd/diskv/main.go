@@ -0,0 +1,159 @@
+// Command diskv inspects and edits a diskv store from the shell, decoding
+// values the same way the library does.
+//
+// Usage:
+//
+//	diskv [-base dir] [-transform preset] [-compression codec] [-readonly] command [args]
+//
+// The commands are get, put, rm, ls, stat, import, export, fsck, du, bench
+// and serve; run "diskv command -h" for the flags of each. The commands
+// that only inspect the store always open it read-only.
+package main
+
+import (
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"studydiskv"
+)
+
+var (
+	basePath    = flag.String("base", "diskv-data", "base path of the store")
+	transform   = flag.String("transform", "flat", "key transform: flat, block, md5 or path")
+	compression = flag.String("compression", "none", "compression of written values: none, gzip, zlib, snappy or seekable")
+	readOnly    = flag.Bool("readonly", false, "refuse to change the store")
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"get":    {"get key", get},
+	"put":    {"put key [file]", put},
+	"rm":     {"rm key...", rm},
+	"ls":     {"ls [-index] [-l] [prefix]", ls},
+	"stat":   {"stat key...", stat},
+	"import": {"import [-move] [-archive] path [key]", importCmd},
+	"export": {"export [-o file] [-metadata] [prefix]", export},
+	"fsck":   {"fsck [prefix]", fsck},
+	"du":     {"du [prefix]", du},
+	"bench":  {"bench [-n count] [-size bytes]", bench},
+	"serve":  {"serve [-addr addr] [-index]", serve},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "diskv: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "diskv %s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: diskv [flags] command [args]\n\nflags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\ncommands:\n")
+	for _, name := range []string{"get", "put", "rm", "ls", "stat", "import", "export", "fsck", "du", "bench", "serve"} {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+// options builds the store's Options from the global flags. No cache is
+// configured, so every read goes to disk.
+func options() (studydiskv.Options, error) {
+	o := studydiskv.Options{BasePath: *basePath, ReadOnly: *readOnly}
+
+	switch *transform {
+	case "flat":
+	case "block":
+		o.Transform = blockTransform
+	case "md5":
+		o.AdvancedTransform, o.InverseTransform = md5Transform, fileNameInverse
+	case "path":
+		o.AdvancedTransform, o.InverseTransform = pathTransform, pathInverse
+	default:
+		return o, fmt.Errorf("unknown transform %q", *transform)
+	}
+
+	switch *compression {
+	case "none":
+	case "gzip":
+		o.Compression = studydiskv.NewGzipCompression()
+	case "zlib":
+		o.Compression = studydiskv.NewZlibCompression()
+	case "snappy":
+		o.Compression = studydiskv.NewSnappyCompression()
+	case "seekable":
+		o.Compression = studydiskv.NewSeekableCompression(0)
+	default:
+		return o, fmt.Errorf("unknown compression %q", *compression)
+	}
+	return o, nil
+}
+
+func open() (*studydiskv.Diskv, error) {
+	o, err := options()
+	if err != nil {
+		return nil, err
+	}
+	return studydiskv.New(o), nil
+}
+
+func openReadOnly() (*studydiskv.Diskv, error) {
+	o, err := options()
+	if err != nil {
+		return nil, err
+	}
+	o.ReadOnly = true
+	return studydiskv.New(o), nil
+}
+
+const transformBlockSize = 2
+
+// blockTransform nests keys in directories named by their leading pairs
+// of characters.
+func blockTransform(s string) []string {
+	pathSlice := make([]string, len(s)/transformBlockSize)
+	for i := range pathSlice {
+		pathSlice[i] = s[i*transformBlockSize : (i+1)*transformBlockSize]
+	}
+	return pathSlice
+}
+
+// md5Transform spreads keys over two levels of directories named after
+// the hex MD5 of the key.
+func md5Transform(s string) *studydiskv.PathKey {
+	sum := fmt.Sprintf("%x", md5.Sum([]byte(s)))
+	return &studydiskv.PathKey{Path: []string{sum[0:2], sum[2:4]}, FileName: s}
+}
+
+func fileNameInverse(pathKey *studydiskv.PathKey) string {
+	return pathKey.FileName
+}
+
+// pathTransform maps slash-separated keys onto directories.
+func pathTransform(s string) *studydiskv.PathKey {
+	path := strings.Split(s, "/")
+	last := len(path) - 1
+	return &studydiskv.PathKey{Path: path[:last], FileName: path[last]}
+}
+
+func pathInverse(pathKey *studydiskv.PathKey) string {
+	return strings.Join(append(append([]string{}, pathKey.Path...), pathKey.FileName), "/")
+}
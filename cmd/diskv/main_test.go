@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the command itself when re-executed by diskv, so that tests
+// see its real output and exit status.
+func TestMain(m *testing.M) {
+	if os.Getenv("DISKV_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// diskv runs the command with args and stdin, returning its stdout, stderr
+// and exit status.
+func diskv(t *testing.T, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "DISKV_TEST_MAIN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return stdout.String(), stderr.String(), exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "store")
+	file := filepath.Join(dir, "file")
+	archive := filepath.Join(dir, "archive.tar")
+	if err := os.WriteFile(file, []byte("from a file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		args   []string
+		stdin  string
+		status int
+		stdout string // contained in the output
+		stderr string // contained in the error output
+	}{
+		{args: []string{}, status: 2, stderr: "usage: diskv"},
+		{args: []string{"frob"}, status: 2, stderr: `unknown command "frob"`},
+		{args: []string{"-transform", "frob", "ls"}, status: 1, stderr: `unknown transform "frob"`},
+
+		{args: []string{"put"}, status: 1, stderr: "diskv put: wrong number of arguments"},
+		{args: []string{"put", "a", "b", "c"}, status: 1, stderr: "wrong number of arguments"},
+		{args: []string{"put", "alpha"}, stdin: "from stdin"},
+		{args: []string{"put", "beta", file}},
+		{args: []string{"put", "gamma", filepath.Join(dir, "missing")}, status: 1, stderr: "no such file"},
+
+		{args: []string{"get"}, status: 1, stderr: "wrong number of arguments"},
+		{args: []string{"get", "alpha"}, stdout: "from stdin"},
+		{args: []string{"get", "beta"}, stdout: "from a file"},
+		{args: []string{"get", "gamma"}, status: 1, stderr: "diskv get:"},
+
+		{args: []string{"ls"}, stdout: "alpha\nbeta\n"},
+		{args: []string{"ls", "b"}, stdout: "beta\n"},
+		{args: []string{"ls", "-index", "a"}, stdout: "alpha\n"},
+		{args: []string{"ls", "-l"}, stdout: "10  alpha"},
+		{args: []string{"ls", "a", "b"}, status: 1, stderr: "wrong number of arguments"},
+
+		{args: []string{"stat"}, status: 1, stderr: "wrong number of arguments"},
+		{args: []string{"stat", "alpha"}, stdout: "size:     10\n"},
+		{args: []string{"stat", "gamma"}, status: 1, stderr: "gamma:"},
+
+		{args: []string{"fsck", "a", "b"}, status: 1, stderr: "wrong number of arguments"},
+		{args: []string{"fsck"}, stdout: "2 values ok"},
+
+		{args: []string{"du", "a", "b"}, status: 1, stderr: "wrong number of arguments"},
+		{args: []string{"du"}, stdout: "keys:   2\n"},
+		{args: []string{"du", "a"}, stdout: "size:   10\n"},
+
+		{args: []string{"export", "a", "b"}, status: 1, stderr: "wrong number of arguments"},
+		{args: []string{"export", "-o", archive}},
+
+		{args: []string{"rm"}, status: 1, stderr: "wrong number of arguments"},
+		{args: []string{"rm", "alpha", "beta"}},
+		{args: []string{"rm", "alpha"}, status: 1, stderr: "alpha:"},
+		{args: []string{"du"}, stdout: "keys:   0\n"},
+
+		{args: []string{"import"}, status: 1, stderr: "wrong number of arguments"},
+		{args: []string{"import", "-archive", archive}},
+		{args: []string{"ls"}, stdout: "alpha\nbeta\n"},
+		{args: []string{"import", file, "delta"}},
+		{args: []string{"get", "delta"}, stdout: "from a file"},
+		{args: []string{"import", dir, "key"}, status: 1, stderr: "a key cannot be given for a directory"},
+
+		{args: []string{"-readonly", "put", "epsilon"}, status: 1, stderr: "read-only"},
+
+		{args: []string{"bench", "extra"}, status: 1, stderr: "wrong number of arguments"},
+		{args: []string{"bench", "-n", "10", "-size", "64"}, stdout: "erase"},
+
+		{args: []string{"serve", "extra"}, status: 1, stderr: "wrong number of arguments"},
+		{args: []string{"serve", "-addr", "bad address"}, status: 1, stderr: "diskv serve:"},
+	} {
+		args := append([]string{"-base", base}, tc.args...)
+		if len(tc.args) == 0 {
+			args = nil
+		}
+		stdout, stderr, status := diskv(t, tc.stdin, args...)
+		if status != tc.status {
+			t.Errorf("%v: want status %d, have %d (%s)", tc.args, tc.status, status, stderr)
+		}
+		if !strings.Contains(stdout, tc.stdout) {
+			t.Errorf("%v: want output containing %q, have %q", tc.args, tc.stdout, stdout)
+		}
+		if !strings.Contains(stderr, tc.stderr) {
+			t.Errorf("%v: want error output containing %q, have %q", tc.args, tc.stderr, stderr)
+		}
+	}
+}
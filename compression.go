@@ -1,10 +1,28 @@
 package studydiskv
 
 import (
+	"bufio"
+	"bytes"
 	"compress/flate"
 	"compress/gzip"
 	"compress/zlib"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// codecMagic starts the header written in front of values stored with a
+// Codec. The byte following it is the codec's ID.
+const codecMagic = "\x89dkv"
+
+const (
+	rawCodecID byte = iota
+	gzipCodecID
+	zlibCodecID
+	snappyCodecID
+	zlibDictCodecID
+	seekableCodecID
 )
 
 type Compression interface {
@@ -12,17 +30,92 @@ type Compression interface {
 	Reader(src io.Reader) (io.ReadCloser, error)
 }
 
-func NewGzipCompression() Compression {
+// Codec is a Compression that identifies itself in a header stored with
+// each value, so values are decoded with the codec that wrote them
+// whatever Options.Compression is set to later.
+type Codec interface {
+	Compression
+	CodecID() byte
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{}
+)
+
+func init() {
+	RegisterCodec(NewNoCompression())
+	RegisterCodec(NewGzipCompression())
+	RegisterCodec(NewZlibCompression())
+	RegisterCodec(NewSnappyCompression())
+	RegisterCodec(&dictCodec{})
+	RegisterCodec(NewSeekableCompression(0))
+}
+
+// RegisterCodec makes values stored with c's ID decodable. It panics if
+// the ID is already taken.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, dup := codecs[c.CodecID()]; dup {
+		panic(fmt.Sprintf("codec %d registered twice", c.CodecID()))
+	}
+	codecs[c.CodecID()] = c
+}
+
+func lookupCodec(id byte) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return codecs[id]
+}
+
+func NewNoCompression() Codec {
+	return &codec{
+		id: rawCodecID,
+		genericCompression: genericCompression{
+			wf: func(w io.Writer) (io.WriteCloser, error) {
+				return &nopWriteCloser{w}, nil
+			},
+			rf: func(r io.Reader) (io.ReadCloser, error) {
+				return ioutil.NopCloser(r), nil
+			},
+		},
+	}
+}
+
+func NewGzipCompression() Codec {
 	return NewGzipCompressionLevel(flate.DefaultCompression)
 }
 
-func NewGzipCompressionLevel(level int) Compression {
-	return &genericCompression{
-		wf: func(w io.Writer) (io.WriteCloser, error) {
-			return gzip.NewWriterLevel(w, level)
+func NewGzipCompressionLevel(level int) Codec {
+	return &codec{
+		id:     gzipCodecID,
+		concat: true,
+		genericCompression: genericCompression{
+			wf: func(w io.Writer) (io.WriteCloser, error) {
+				return gzip.NewWriterLevel(w, level)
+			},
+			rf: func(r io.Reader) (io.ReadCloser, error) {
+				return gzip.NewReader(r)
+			},
 		},
-		rf: func(r io.Reader) (io.ReadCloser, error) {
-			return gzip.NewReader(r)
+	}
+}
+
+func NewZlibCompression() Codec {
+	return NewZlibCompressionLevel(flate.DefaultCompression)
+}
+
+func NewZlibCompressionLevel(level int) Codec {
+	return &codec{
+		id: zlibCodecID,
+		genericCompression: genericCompression{
+			wf: func(w io.Writer) (io.WriteCloser, error) {
+				return zlib.NewWriterLevel(w, level)
+			},
+			rf: func(r io.Reader) (io.ReadCloser, error) {
+				return zlib.NewReader(r)
+			},
 		},
 	}
 }
@@ -50,3 +143,152 @@ func (g *genericCompression) Writer(dst io.Writer) (io.WriteCloser, error) {
 func (g *genericCompression) Reader(src io.Reader) (io.ReadCloser, error) {
 	return g.rf(src)
 }
+
+type codec struct {
+	genericCompression
+	id     byte
+	concat bool
+}
+
+func (c *codec) CodecID() byte {
+	return c.id
+}
+
+func (c *codec) concatenable() bool {
+	return c.concat
+}
+
+// concatenable is implemented by codecs whose streams, concatenated, decode
+// to the concatenation of what was written to each.
+type concatenable interface {
+	concatenable() bool
+}
+
+// newValueWriter returns a writer storing what is written to it into dst,
+// compressed with c and preceded by c's header if c is a Codec.
+func newValueWriter(dst io.Writer, c Compression) (io.WriteCloser, error) {
+	if c == nil {
+		return &nopWriteCloser{dst}, nil
+	}
+	if cc, ok := c.(Codec); ok {
+		if _, err := io.WriteString(dst, codecMagic+string([]byte{cc.CodecID()})); err != nil {
+			return nil, err
+		}
+	}
+	return c.Writer(dst)
+}
+
+// escapeRaw returns the Compression to store r with when no compression is
+// configured: none, unless r happens to begin with codecMagic or looks like
+// a value sniffCodec recognizes, in which case the raw codec's header keeps
+// it from being mistaken for an encoded value. Headerless values are thus
+// only ever ones written before headers existed.
+func escapeRaw(r io.Reader) (io.Reader, Compression) {
+	br := bufio.NewReader(r)
+	if p, _ := br.Peek(len(codecMagic)); needsRawHeader(p) {
+		return br, NewNoCompression()
+	}
+	return br, nil
+}
+
+// needsRawHeader reports whether a raw value beginning with p would be
+// mistaken for an encoded one if stored without a header.
+func needsRawHeader(p []byte) bool {
+	return string(p) == codecMagic || sniffCodec(p) != rawCodecID
+}
+
+// sampleCompression test-compresses the first sampleSize bytes of r with c
+// and returns the raw codec instead of c if they do not shrink below
+// maxRatio of their size.
+func sampleCompression(r io.Reader, c Compression, sampleSize int, maxRatio float64) (io.Reader, Compression) {
+	br := bufio.NewReaderSize(r, sampleSize)
+	sample, _ := br.Peek(sampleSize)
+	if len(sample) == 0 {
+		return br, c
+	}
+
+	var n countingWriter
+	w, err := c.Writer(&n)
+	if err != nil {
+		return br, c
+	}
+	w.Write(sample)
+	w.Close()
+
+	if float64(n) > maxRatio*float64(len(sample)) {
+		return br, NewNoCompression()
+	}
+	return br, c
+}
+
+type countingWriter int64
+
+func (n *countingWriter) Write(p []byte) (int, error) {
+	*n += countingWriter(len(p))
+	return len(p), nil
+}
+
+// newValueReader decodes a stored value. Values carrying a codec header are
+// decoded by the registered codec; values without one were stored before
+// headers existed, or with a Compression that is not a Codec. Those are
+// decoded as gzip or zlib if they look it and legacy is a Codec, since the
+// store may have switched codecs since, and otherwise with legacy, the
+// Compression they were presumably written with. Dictionaries are looked up
+// in d.
+func (d *Diskv) newValueReader(src io.Reader, legacy Compression) (io.ReadCloser, error) {
+	br := bufio.NewReader(src)
+	hdr, _ := br.Peek(len(codecMagic) + 1)
+
+	c, n, err := valueCodec(hdr, legacy)
+	if err != nil {
+		return nil, err
+	}
+	br.Discard(n)
+	if c == nil {
+		return ioutil.NopCloser(br), nil
+	}
+	return d.decoder(c).Reader(br)
+}
+
+// valueCodec returns the Compression that decodes a stored value starting
+// with hdr, nil if the value is raw, and the length of its codec header.
+func valueCodec(hdr []byte, legacy Compression) (Compression, int, error) {
+	if len(hdr) > len(codecMagic) && string(hdr[:len(codecMagic)]) == codecMagic {
+		c := lookupCodec(hdr[len(codecMagic)])
+		if c == nil {
+			return nil, 0, fmt.Errorf("unknown codec %d", hdr[len(codecMagic)])
+		}
+		if c.CodecID() == rawCodecID {
+			return nil, len(codecMagic) + 1, nil
+		}
+		return c, len(codecMagic) + 1, nil
+	}
+
+	switch c := legacy.(type) {
+	case nil:
+	case Codec:
+		// zlib's two byte header is easily mistaken for text, so it is
+		// only trusted in stores that compress.
+		switch id := sniffCodec(hdr); {
+		case id == gzipCodecID, id == zlibCodecID && c.CodecID() != rawCodecID:
+			return lookupCodec(id), 0, nil
+		}
+	default:
+		return c, 0, nil
+	}
+	return nil, 0, nil
+}
+
+// sniffCodec recognizes the formats of codecs whose values may have been
+// stored without a header.
+func sniffCodec(hdr []byte) byte {
+	switch {
+	case len(hdr) < 2:
+	case bytes.HasPrefix(hdr, []byte{0x1f, 0x8b, 8}):
+		return gzipCodecID
+	case hdr[0]&0x0f == 8 && hdr[0]>>4 <= 7 && hdr[1]&0x20 == 0 &&
+		(uint(hdr[0])<<8|uint(hdr[1]))%31 == 0:
+		return zlibCodecID
+	}
+	return rawCodecID
+}
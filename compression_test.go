@@ -1,10 +1,17 @@
 package studydiskv
 
 import (
+	"bytes"
 	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -24,7 +31,7 @@ func testCompressionWith(t *testing.T, c Compression, name string) {
 	sz := 4096
 	val := make([]byte, sz)
 	for i := 0; i < sz; i++ {
-		val[i] = byte('a' + rand.Intn(26))
+		val[i] = byte('a' + rand.Intn(4))
 	}
 
 	key := "a"
@@ -69,5 +76,408 @@ func TestGzipBestSpedd(t *testing.T) {
 }
 
 func TestZl(t *testing.T) {
-	testCompressionWith(t, NewGzipCompression(), "zlib")
+	testCompressionWith(t, NewZlibCompression(), "zlib")
+}
+
+func testCompressedCacheWith(t *testing.T, decompressed bool) {
+	d := New(Options{
+		BasePath:          "compression-test",
+		CacheSizeMax:      1 << 20,
+		CacheDecompressed: decompressed,
+		Compression:       NewGzipCompression(),
+	})
+	defer d.EraseAll()
+
+	val := make([]byte, 4096)
+	for i := range val {
+		val[i] = byte('a' + rand.Intn(4))
+	}
+
+	key := "a"
+	if err := d.Write(key, val); err != nil {
+		t.Fatal(err)
+	}
+
+	uncached, err := d.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.isCache(key) {
+		t.Fatalf("key not cached after read")
+	}
+	cached, err := d.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cmpByte(uncached, val) {
+		t.Errorf("uncached read differs from written value")
+	}
+	if !cmpByte(cached, uncached) {
+		t.Errorf("cached read differs from uncached read")
+	}
+
+	fi, err := os.Stat(d.completeFilename(d.transform(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := uint64(fi.Size())
+	if decompressed {
+		want = uint64(len(val))
+	}
+	if d.cacheSize != want {
+		t.Errorf("cache size: want %d, have %d", want, d.cacheSize)
+	}
+}
+
+func TestCompressedCache(t *testing.T) {
+	testCompressedCacheWith(t, false)
+}
+
+func TestDecompressedCache(t *testing.T) {
+	testCompressedCacheWith(t, true)
+}
+
+func TestCacheNotStale(t *testing.T) {
+	d := New(Options{
+		BasePath:     "compression-test",
+		CacheSizeMax: 1024,
+	})
+	defer d.EraseAll()
+
+	d.WriteString("a", "old")
+	rc, err := d.ReadStream("a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.WriteString("a", "new")
+	ioutil.ReadAll(rc)
+	rc.Close()
+
+	if v := d.ReadString("a"); v != "new" {
+		t.Errorf("want %q, have %q", "new", v)
+	}
+}
+
+func storedCodec(t *testing.T, d *Diskv, key string) string {
+	b, err := ioutil.ReadFile(d.completeFilename(d.transform(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) > len(codecMagic) && string(b[:len(codecMagic)]) == codecMagic {
+		return fmt.Sprint(b[len(codecMagic)])
+	}
+	return "none"
+}
+
+func TestCompressionSwitch(t *testing.T) {
+	val := "the quick brown fox jumps over the lazy dog"
+	codecs := []Compression{nil, NewGzipCompression(), NewZlibCompression(), NewNoCompression()}
+	for i, c := range codecs {
+		d := New(Options{
+			BasePath:    "compression-test",
+			Compression: c,
+		})
+		if err := d.WriteString(fmt.Sprint(i), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range codecs {
+		d := New(Options{
+			BasePath:    "compression-test",
+			Compression: c,
+		})
+		for i := range codecs {
+			if have := d.ReadString(fmt.Sprint(i)); have != val {
+				t.Errorf("value written with codec #%d, read with %v: have %q", i, c, have)
+			}
+		}
+	}
+	New(Options{BasePath: "compression-test"}).EraseAll()
+}
+
+func TestCompressionLegacy(t *testing.T) {
+	d := New(Options{
+		BasePath:    "compression-test",
+		Compression: NewGzipCompression(),
+	})
+	defer d.EraseAll()
+
+	val := []byte("legacy value")
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(val)
+	w.Close()
+
+	os.MkdirAll(d.BasePath, 0777)
+	ioutil.WriteFile(d.completeFilename(d.transform("gzipped")), buf.Bytes(), 0666)
+	ioutil.WriteFile(d.completeFilename(d.transform("raw")), val, 0666)
+
+	for _, key := range []string{"gzipped", "raw"} {
+		if have, err := d.Read(key); err != nil || !cmpByte(have, val) {
+			t.Errorf("%s: want %q, have %q (err = %v)", key, val, have, err)
+		}
+	}
+}
+
+func TestRawValueWithMagic(t *testing.T) {
+	d := New(Options{
+		BasePath: "compression-test",
+	})
+	defer d.EraseAll()
+
+	val := codecMagic + "\x01not gzip"
+	if err := d.WriteString("a", val); err != nil {
+		t.Fatal(err)
+	}
+	if have := d.ReadString("a"); have != val {
+		t.Errorf("want %q, have %q", val, have)
+	}
+	if err := d.WriteString("b", "plain"); err != nil {
+		t.Fatal(err)
+	}
+	if have := storedCodec(t, d, "b"); have != "none" {
+		t.Errorf("plain value stored with codec %s", have)
+	}
+}
+
+func TestRecompress(t *testing.T) {
+	d := New(Options{
+		BasePath:    "compression-test",
+		Compression: NewGzipCompression(),
+	})
+	defer d.EraseAll()
+
+	vals := map[string]string{"a": "aaaaaaaaaaaaaaaa", "b": "bbbbbbbbbbbbbbbbb", "c": "c"}
+	for k, v := range vals {
+		d.WriteString(k, v)
+	}
+
+	// Values are read while recompressing.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for k := range vals {
+			d.Stat(k)
+		}
+	}()
+	if err := d.Recompress(context.Background(), NewZlibCompression()); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if c, ok := d.Compression.(Codec); !ok || c.CodecID() != gzipCodecID {
+		t.Errorf("store's Compression changed")
+	}
+
+	for k, v := range vals {
+		if have := storedCodec(t, d, k); have != fmt.Sprint(zlibCodecID) {
+			t.Errorf("%s: stored with codec %s after recompress", k, have)
+		}
+		if have := d.ReadString(k); have != v {
+			t.Errorf("%s: want %q, have %q", k, v, have)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.Recompress(ctx, NewGzipCompression()); err != context.Canceled {
+		t.Errorf("want context.Canceled, have %v", err)
+	}
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	d := New(Options{
+		BasePath:          "compression-test",
+		Compression:       NewGzipCompression(),
+		CompressionSample: 1024,
+	})
+	defer d.EraseAll()
+
+	noise := make([]byte, 8192)
+	rand.Read(noise)
+	text := bytes.Repeat([]byte(`{"owner":"alice","size":42}`), 300)
+
+	d.Write("noise", noise)
+	d.Write("text", text)
+
+	if have := storedCodec(t, d, "noise"); have != fmt.Sprint(rawCodecID) {
+		t.Errorf("noise stored with codec %s, want raw", have)
+	}
+	if have := storedCodec(t, d, "text"); have != fmt.Sprint(gzipCodecID) {
+		t.Errorf("text stored with codec %s, want gzip", have)
+	}
+	if have, _ := d.Read("noise"); !cmpByte(have, noise) {
+		t.Errorf("noise read back differently")
+	}
+	if have, _ := d.Read("text"); !cmpByte(have, text) {
+		t.Errorf("text read back differently")
+	}
+}
+
+func TestCompressionForKey(t *testing.T) {
+	dict := []byte("the quick brown fox")
+	d := New(Options{
+		BasePath: "compression-test",
+		CompressionFor: func(key string) Compression {
+			switch {
+			case strings.HasSuffix(key, ".jpg"):
+				return nil
+			case strings.HasSuffix(key, ".dict"):
+				return NewZipCompressionLevelDict(flate.BestCompression, dict)
+			}
+			return NewGzipCompression()
+		},
+	})
+	defer d.EraseAll()
+
+	val := "the quick brown fox jumps over the lazy dog"
+	for _, key := range []string{"a.jpg", "a.json", "a.dict"} {
+		if err := d.WriteString(key, val); err != nil {
+			t.Fatal(err)
+		}
+		if have := d.ReadString(key); have != val {
+			t.Errorf("%s: want %q, have %q", key, val, have)
+		}
+	}
+	if have := storedCodec(t, d, "a.jpg"); have != "none" {
+		t.Errorf("a.jpg stored with codec %s, want none", have)
+	}
+	if have := storedCodec(t, d, "a.json"); have != fmt.Sprint(gzipCodecID) {
+		t.Errorf("a.json stored with codec %s, want gzip", have)
+	}
+}
+
+func TestSnappy(t *testing.T) {
+	testCompressionWith(t, NewSnappyCompression(), "snappy")
+}
+
+func benchmarkValue(size int) []byte {
+	val := make([]byte, 0, size)
+	for len(val) < size {
+		val = append(val, fmt.Sprintf(`{"id":%d,"owner":"user-%d","tags":["a","b"]},`, rand.Intn(1e6), rand.Intn(100))...)
+	}
+	return val[:size]
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	codecs := []struct {
+		name string
+		c    Compression
+	}{
+		{"none", nil},
+		{"gzip", NewGzipCompression()},
+		{"gzip-speed", NewGzipCompressionLevel(flate.BestSpeed)},
+		{"zlib", NewZlibCompression()},
+		{"snappy", NewSnappyCompression()},
+	}
+	sizes := []int{1 << 10, 64 << 10, 1 << 20}
+
+	for _, codec := range codecs {
+		for _, size := range sizes {
+			val := benchmarkValue(size)
+			d := New(Options{
+				BasePath:    "compression-bench",
+				Compression: codec.c,
+			})
+
+			b.Run(fmt.Sprintf("write/%s/%d", codec.name, size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					if err := d.Write("key", val); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run(fmt.Sprintf("read/%s/%d", codec.name, size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					if _, err := d.Read("key"); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			d.EraseAll()
+		}
+	}
+}
+
+// TestCompressionLegacySwitched reads values written without headers, as
+// before headers existed, after the store switched codecs.
+func TestCompressionLegacySwitched(t *testing.T) {
+	val := []byte("legacy value")
+	var gz, zl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(val)
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write(val)
+	zw.Close()
+
+	for _, c := range []Compression{NewGzipCompression(), NewZlibCompression(), NewSnappyCompression(), NewNoCompression()} {
+		d := New(Options{
+			BasePath:    "compression-test",
+			Compression: c,
+		})
+		os.MkdirAll(d.BasePath, 0777)
+		ioutil.WriteFile(d.completeFilename(d.transform("gzipped")), gz.Bytes(), 0666)
+		ioutil.WriteFile(d.completeFilename(d.transform("zlibbed")), zl.Bytes(), 0666)
+		ioutil.WriteFile(d.completeFilename(d.transform("raw")), val, 0666)
+
+		keys := []string{"gzipped", "raw"}
+		if c.(Codec).CodecID() != rawCodecID {
+			keys = append(keys, "zlibbed")
+		}
+		for _, key := range keys {
+			if have, err := d.Read(key); err != nil || !cmpByte(have, val) {
+				t.Errorf("%T: %s: want %q, have %q (err = %v)", c, key, val, have, err)
+			}
+		}
+		d.EraseAll()
+	}
+}
+
+func TestCompressionRawLooksEncoded(t *testing.T) {
+	var gz, zl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte("inner payload"))
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write([]byte("inner payload"))
+	zw.Close()
+	vals := map[string][]byte{"blob.gz": gz.Bytes(), "blob.z": zl.Bytes()}
+
+	for _, c := range []Compression{NewGzipCompression(), NewZlibCompression(), NewSnappyCompression(), NewNoCompression()} {
+		d := New(Options{BasePath: "test-raw-encoded"})
+		for key, val := range vals {
+			if err := d.Write(key, val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Moved in by renaming, which the store must not do as it is.
+		moved := filepath.Join(t.TempDir(), "moved.gz")
+		if err := ioutil.WriteFile(moved, gz.Bytes(), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Import(moved, "moved.gz", true); err != nil {
+			t.Fatal(err)
+		}
+		vals["moved.gz"] = gz.Bytes()
+
+		d = New(Options{BasePath: "test-raw-encoded", Compression: c})
+		for key, val := range vals {
+			if have, err := d.Read(key); err != nil || !cmpByte(have, val) {
+				t.Errorf("%T: %s: want %d stored bytes, have %q (err = %v)", c, key, len(val), have, err)
+			}
+		}
+		if err := d.Recompress(context.Background(), c.(Codec)); err != nil {
+			t.Fatal(err)
+		}
+		for key, val := range vals {
+			if have, err := d.Read(key); err != nil || !cmpByte(have, val) {
+				t.Errorf("%T: %s: recompressed to %q (err = %v)", c, key, have, err)
+			}
+		}
+		d.EraseAll()
+	}
 }
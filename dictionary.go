@@ -0,0 +1,338 @@
+package studydiskv
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	maxDictionarySize    = 32 << 10
+	trainSampleSize      = 128 << 10
+	trainGramSize        = 6
+	trainSegmentSize     = 64
+	dictionaryPathPrefix = "dict"
+)
+
+// Dictionary is a preset zlib dictionary. Its ID, the Adler-32 checksum of
+// its Data as zlib itself uses, is stored with every value compressed with
+// it.
+type Dictionary struct {
+	ID   uint32
+	Data []byte
+}
+
+func NewDictionary(data []byte) *Dictionary {
+	return &Dictionary{ID: adler32.Checksum(data), Data: data}
+}
+
+var errDictionaryCollision = errors.New("another dictionary has the same ID")
+
+var (
+	dictionariesMu sync.RWMutex
+	dictionaries   = map[uint32]*Dictionary{}
+)
+
+// RegisterDictionary makes values compressed with dict decodable in every
+// store, even one that did not save it. A store's own dictionaries take
+// precedence. Adler-32 collides easily, so registering a dictionary whose ID
+// is already taken by different data is an error: values stored with that
+// ID could otherwise be decoded with the wrong dictionary.
+func RegisterDictionary(dict *Dictionary) error {
+	dictionariesMu.Lock()
+	defer dictionariesMu.Unlock()
+	if other, ok := dictionaries[dict.ID]; ok && !bytes.Equal(other.Data, dict.Data) {
+		return fmt.Errorf("dictionary %08x: %s", dict.ID, errDictionaryCollision)
+	}
+	dictionaries[dict.ID] = dict
+	return nil
+}
+
+func lookupDictionary(id uint32) *Dictionary {
+	dictionariesMu.RLock()
+	defer dictionariesMu.RUnlock()
+	return dictionaries[id]
+}
+
+type dictCodec struct {
+	level  int
+	dict   *Dictionary
+	lookup func(id uint32) (*Dictionary, error) // for decoding; nil for the registered ones
+}
+
+// NewZlibDictCompression compresses with zlib and a preset dictionary.
+// The dictionary's ID is stored with each value and the dictionary itself
+// is saved in the store on first use, so values stay readable after
+// Options.Compression moves on to another dictionary. Writing with the
+// codec fails in a store holding another dictionary with the same ID.
+func NewZlibDictCompression(level int, dict *Dictionary) Codec {
+	return &dictCodec{level: level, dict: dict}
+}
+
+func (c *dictCodec) CodecID() byte {
+	return zlibDictCodecID
+}
+
+func (c *dictCodec) Writer(dst io.Writer) (io.WriteCloser, error) {
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], c.dict.ID)
+	if _, err := dst.Write(id[:]); err != nil {
+		return nil, err
+	}
+	return zlib.NewWriterLevelDict(dst, c.level, c.dict.Data)
+}
+
+func (c *dictCodec) Reader(src io.Reader) (io.ReadCloser, error) {
+	var id [4]byte
+	if _, err := io.ReadFull(src, id[:]); err != nil {
+		return nil, err
+	}
+	lookup := c.lookup
+	if lookup == nil {
+		lookup = registeredDictionary
+	}
+	dict, err := lookup(binary.BigEndian.Uint32(id[:]))
+	if err != nil {
+		return nil, err
+	}
+	return zlib.NewReaderDict(src, dict.Data)
+}
+
+func registeredDictionary(id uint32) (*Dictionary, error) {
+	if dict := lookupDictionary(id); dict != nil {
+		return dict, nil
+	}
+	return nil, fmt.Errorf("unknown dictionary %08x", id)
+}
+
+// decoder returns c, made to look dictionaries up in the store if it uses
+// them.
+func (d *Diskv) decoder(c Compression) Compression {
+	if _, ok := c.(*dictCodec); ok {
+		return &dictCodec{lookup: d.dictionary}
+	}
+	return c
+}
+
+// dictionary returns the dictionary with the given ID: the store's own, or
+// failing that a registered one. Only values compressed with a dictionary
+// that failed to load, or that is nowhere to be found, are undecodable.
+func (d *Diskv) dictionary(id uint32) (*Dictionary, error) {
+	d.dictMu.RLock()
+	dict, err := d.dicts[id], d.dictErrs[id]
+	listErr := d.dictsErr
+	d.dictMu.RUnlock()
+	switch {
+	case dict != nil:
+		return dict, nil
+	case err != nil:
+		return nil, fmt.Errorf("dictionary %08x: %s", id, err)
+	}
+	if dict := lookupDictionary(id); dict != nil {
+		return dict, nil
+	}
+	if listErr != nil {
+		return nil, fmt.Errorf("dictionary %08x: %s", id, listErr)
+	}
+	return nil, fmt.Errorf("unknown dictionary %08x", id)
+}
+
+func (d *Diskv) dictionaryDir() string {
+	return filepath.Join(d.BasePath, metaDir, dictionaryPathPrefix)
+}
+
+// AddDictionary saves dict in the store, so that other Diskv instances
+// opened on it can decode values compressed with it.
+func (d *Diskv) AddDictionary(dict *Dictionary) error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.saveDictionaryWithLock(dict)
+}
+
+// saveDictionaryWithLock saves dict in the store unless it is there
+// already, refusing a dictionary whose ID the store uses for another.
+func (d *Diskv) saveDictionaryWithLock(dict *Dictionary) error {
+	d.dictMu.RLock()
+	other, err := d.dicts[dict.ID], d.dictErrs[dict.ID]
+	d.dictMu.RUnlock()
+	switch {
+	case other != nil && bytes.Equal(other.Data, dict.Data):
+		return nil
+	case other != nil:
+		return fmt.Errorf("dictionary %08x: %s", dict.ID, errDictionaryCollision)
+	case err != nil:
+		return fmt.Errorf("dictionary %08x: %s", dict.ID, err)
+	}
+
+	// Another Diskv on the store may have saved one since this loaded.
+	filename := filepath.Join(d.dictionaryDir(), fmt.Sprintf("%08x", dict.ID))
+	data, err := readFile(d.FileSystem, filename)
+	switch {
+	case err == nil && !bytes.Equal(data, dict.Data):
+		return fmt.Errorf("dictionary %08x: %s", dict.ID, errDictionaryCollision)
+	case os.IsNotExist(err):
+		err = writeFileAtomic(d.FileSystem, filename, d.PathPerm, d.FilePerm, func(f io.Writer) error {
+			_, err := f.Write(dict.Data)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	d.dictMu.Lock()
+	d.dicts[dict.ID] = dict
+	d.dictMu.Unlock()
+	return nil
+}
+
+// loadDictionaries reads the dictionaries saved in the store. Errors are
+// kept, to be reported when a value compressed with the dictionary at fault
+// is read or written.
+func (d *Diskv) loadDictionaries() {
+	d.dictMu.Lock()
+	defer d.dictMu.Unlock()
+	d.dicts, d.dictErrs = map[uint32]*Dictionary{}, map[uint32]error{}
+
+	entries, err := d.FileSystem.ReadDir(d.dictionaryDir())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		d.dictsErr = fmt.Errorf("load dictionaries: %s", err)
+		return
+	}
+	for _, entry := range entries {
+		id, err := strconv.ParseUint(entry.Name(), 16, 32)
+		if err != nil {
+			continue
+		}
+		data, err := readFile(d.FileSystem, filepath.Join(d.dictionaryDir(), entry.Name()))
+		if err != nil {
+			d.dictErrs[uint32(id)] = fmt.Errorf("load: %s", err)
+			continue
+		}
+		dict := NewDictionary(data)
+		if uint64(dict.ID) != id {
+			d.dictErrs[uint32(id)] = errors.New("load: checksum mismatch")
+			continue
+		}
+		d.dicts[dict.ID] = dict
+	}
+}
+
+// TrainDictionary builds a dictionary of up to size bytes from the values
+// of sampleKeys. It picks, from each of size/64 stretches of the samples, or
+// from one if size is smaller, the 64 byte segment made of the most commonly
+// shared substrings, and puts the best segments last, where zlib reaches
+// them most cheaply.
+func TrainDictionary(ctx context.Context, d *Diskv, sampleKeys []string, size int) (*Dictionary, error) {
+	if size <= 0 || size > maxDictionarySize {
+		size = maxDictionarySize
+	}
+
+	data := []byte{}
+	freq := map[string]int{}
+	for _, key := range sampleKeys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		val, err := d.Read(key)
+		if err != nil {
+			return nil, fmt.Errorf("sample %s: %s", key, err)
+		}
+		if len(val) > trainSampleSize {
+			val = val[:trainSampleSize]
+		}
+
+		seen := map[string]bool{}
+		for i := 0; i+trainGramSize <= len(val); i++ {
+			gram := string(val[i : i+trainGramSize])
+			if !seen[gram] {
+				seen[gram] = true
+				freq[gram]++
+			}
+		}
+		data = append(data, val...)
+	}
+	if len(data) < trainSegmentSize {
+		if len(data) > size {
+			data = data[len(data)-size:]
+		}
+		return NewDictionary(data), nil
+	}
+
+	type segment struct {
+		score int
+		data  []byte
+	}
+	segments := []segment{}
+	// A size below a segment still takes one, cut down at the end.
+	epochs := max(size/trainSegmentSize, 1)
+	if epochs > len(data)/trainSegmentSize {
+		epochs = len(data) / trainSegmentSize
+	}
+	epochLen := len(data) / epochs
+
+	for e := 0; e < epochs; e++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		epoch := data[e*epochLen : (e+1)*epochLen]
+		if len(epoch) < trainSegmentSize {
+			continue
+		}
+
+		// sums[i] is the summed frequency of the grams starting before i.
+		sums := make([]int, len(epoch)+1)
+		for i := range epoch {
+			sums[i+1] = sums[i]
+			if i+trainGramSize <= len(epoch) {
+				if f := freq[string(epoch[i:i+trainGramSize])]; f > 1 {
+					sums[i+1] += f
+				}
+			}
+		}
+
+		best, bestScore := 0, 0
+		for i := 0; i+trainSegmentSize <= len(epoch); i++ {
+			if score := sums[i+trainSegmentSize-trainGramSize+1] - sums[i]; score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if bestScore == 0 {
+			continue
+		}
+
+		seg := epoch[best : best+trainSegmentSize]
+		for i := 0; i+trainGramSize <= len(seg); i++ {
+			delete(freq, string(seg[i:i+trainGramSize]))
+		}
+		segments = append(segments, segment{score: bestScore, data: seg})
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].score < segments[j].score
+	})
+	dict := []byte{}
+	for _, seg := range segments {
+		dict = append(dict, seg.data...)
+	}
+	if len(dict) > size {
+		dict = dict[len(dict)-size:]
+	}
+	return NewDictionary(dict), nil
+}
@@ -0,0 +1,210 @@
+package studydiskv
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func jsonValue(i int) string {
+	return fmt.Sprintf(`{"id":%d,"owner":"user-%d","created":"2026-10-%02d","status":"active","tags":["alpha","beta"]}`,
+		rand.Intn(1e6), i, 1+rand.Intn(28))
+}
+
+func zlibSize(val, dict []byte) int {
+	var buf bytes.Buffer
+	w, _ := zlib.NewWriterLevelDict(&buf, flate.BestCompression, dict)
+	w.Write(val)
+	w.Close()
+	return buf.Len()
+}
+
+func TestTrainDictionary(t *testing.T) {
+	d := New(Options{
+		BasePath: "test-dictionary",
+	})
+	defer d.EraseAll()
+
+	keys := []string{}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprint(i)
+		d.WriteString(key, jsonValue(i))
+		keys = append(keys, key)
+	}
+
+	dict, err := TrainDictionary(context.Background(), d, keys, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dict.Data) == 0 || len(dict.Data) > 1024 {
+		t.Fatalf("dictionary size %d out of range", len(dict.Data))
+	}
+
+	val := []byte(jsonValue(99))
+	if with, without := zlibSize(val, dict.Data), zlibSize(val, nil); with >= without {
+		t.Errorf("dictionary did not help: %d bytes with, %d without", with, without)
+	}
+
+	for _, size := range []int{1, 32, 63, 64, 65} {
+		dict, err := TrainDictionary(context.Background(), d, keys, size)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if len(dict.Data) == 0 || len(dict.Data) > size {
+			t.Errorf("size %d: have %d bytes", size, len(dict.Data))
+		}
+	}
+	d.WriteString("short", "tiny sample")
+	if dict, err := TrainDictionary(context.Background(), d, []string{"short"}, 4); err != nil || string(dict.Data) != "mple" {
+		t.Errorf("short sample: have %q, %v", dict.Data, err)
+	}
+}
+
+func TestDictionaryRotation(t *testing.T) {
+	dict1 := NewDictionary([]byte(`"owner":"user-","status":"active"`))
+	dict2 := NewDictionary([]byte(`"tags":["alpha","beta"]}`))
+
+	d1 := New(Options{
+		BasePath:    "test-dictionary",
+		Compression: NewZlibDictCompression(flate.BestCompression, dict1),
+	})
+	defer d1.EraseAll()
+
+	v1, v2 := jsonValue(1), jsonValue(2)
+	if err := d1.WriteString("old", v1); err != nil {
+		t.Fatal(err)
+	}
+	d1.Compression = NewZlibDictCompression(flate.BestCompression, dict2)
+	if err := d1.WriteString("new", v2); err != nil {
+		t.Fatal(err)
+	}
+
+	dictionariesMu.Lock()
+	delete(dictionaries, dict1.ID)
+	delete(dictionaries, dict2.ID)
+	dictionariesMu.Unlock()
+
+	d2 := New(Options{
+		BasePath: "test-dictionary",
+	})
+	if have := d2.ReadString("old"); have != v1 {
+		t.Errorf("old: want %q, have %q", v1, have)
+	}
+	if have := d2.ReadString("new"); have != v2 {
+		t.Errorf("new: want %q, have %q", v2, have)
+	}
+}
+
+func TestDictionaryCollision(t *testing.T) {
+	// Raising the first and last of three bytes by one and lowering the
+	// middle one by two leaves the Adler-32 checksum unchanged.
+	a := NewDictionary([]byte("dictionary collision abc"))
+	b := NewDictionary([]byte("dictionary collision b`d"))
+	if a.ID != b.ID {
+		t.Fatalf("IDs differ: %08x, %08x", a.ID, b.ID)
+	}
+
+	if err := RegisterDictionary(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterDictionary(NewDictionary(append([]byte{}, a.Data...))); err != nil {
+		t.Errorf("same data registered again: %v", err)
+	}
+	if err := RegisterDictionary(b); err == nil {
+		t.Errorf("colliding dictionary registered")
+	}
+
+	// Each store keeps its own dictionaries, so two stores whose
+	// dictionaries collide work side by side.
+	da := New(Options{
+		BasePath:    "test-dictionary-collision-a",
+		Compression: NewZlibDictCompression(flate.DefaultCompression, a),
+		FileSystem:  NewMemFS(),
+	})
+	db := New(Options{
+		BasePath:    "test-dictionary-collision-b",
+		Compression: NewZlibDictCompression(flate.DefaultCompression, b),
+		FileSystem:  NewMemFS(),
+	})
+	for _, d := range []*Diskv{da, db} {
+		if err := d.WriteString("k", "value in "+d.BasePath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []*Diskv{da, db, New(db.Options)} {
+		if have, err := d.Read("k"); err != nil || string(have) != "value in "+d.BasePath {
+			t.Errorf("%s: have %q, %v", d.BasePath, have, err)
+		}
+	}
+
+	// Within a store, a colliding dictionary is refused.
+	da.Compression = NewZlibDictCompression(flate.DefaultCompression, b)
+	if err := da.WriteString("other", "value"); err == nil {
+		t.Errorf("value written with colliding dictionary")
+	}
+	if err := da.AddDictionary(b); err == nil {
+		t.Errorf("colliding dictionary added")
+	}
+	if err := New(da.Options).AddDictionary(b); err == nil {
+		t.Errorf("colliding dictionary added after reopening")
+	}
+}
+
+func TestDictionaryLoadError(t *testing.T) {
+	mem := NewMemFS()
+	dict := NewDictionary([]byte("dictionary load error"))
+	opts := Options{
+		BasePath:    "test-dictionary-load",
+		Compression: NewZlibDictCompression(flate.DefaultCompression, dict),
+		FileSystem:  mem,
+	}
+	if err := New(opts).WriteString("k", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := opts
+	raw.Compression = nil
+	if err := New(raw).WriteString("raw", "raw value"); err != nil {
+		t.Fatal(err)
+	}
+
+	ffs := newFaultFS(mem)
+	ffs.inject(&fault{op: "OpenFile", path: filepath.Join(metaDir, dictionaryPathPrefix), err: syscall.EIO})
+	opts.FileSystem = ffs
+	d := New(opts)
+	if _, err := d.Read("k"); err == nil {
+		t.Errorf("read succeeded with dictionary unloaded")
+	}
+	if h, err := d.Open("k"); err == nil {
+		if _, err := io.ReadAll(h); err == nil {
+			t.Errorf("handle read succeeded with dictionary unloaded")
+		}
+		h.Close()
+	}
+	if err := d.WriteString("k", "other"); err == nil {
+		t.Errorf("write succeeded with dictionary unloaded")
+	}
+	rec := httptest.NewRecorder()
+	NewHandler(d).ServeHTTP(rec, httptest.NewRequest("PUT", "/keys/k", strings.NewReader("other")))
+	if rec.Code < 500 {
+		t.Errorf("conditional write: have status %d", rec.Code)
+	}
+
+	// Values not needing the dictionary are unaffected.
+	if have, err := d.Read("raw"); err != nil || string(have) != "raw value" {
+		t.Errorf("raw: have %q, %v", have, err)
+	}
+	raw.FileSystem, raw.ReadOnly = ffs, true
+	if have, err := New(raw).Read("raw"); err != nil || string(have) != "raw value" {
+		t.Errorf("raw, read-only: have %q, %v", have, err)
+	}
+}
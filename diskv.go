@@ -2,21 +2,28 @@ package studydiskv
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"iter"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 const (
-	defaultBasePath             = "diskv"
-	defaultFilePerm os.FileMode = 0666
-	defaultPathPerm os.FileMode = 0777
+	defaultBasePath                        = "diskv"
+	defaultFilePerm            os.FileMode = 0666
+	defaultPathPerm            os.FileMode = 0777
+	indexPageSize                          = 1024
+	defaultCompressionMaxRatio             = 0.9
+	metaDir                                = ".diskv"
 )
 
 type PathKey struct {
@@ -28,12 +35,15 @@ type PathKey struct {
 var (
 	defaultAdvancedTransform = func(s string) *PathKey { return &PathKey{Path: []string{}, FileName: s} }
 	defaultInverseTransform  = func(pathKey *PathKey) string { return pathKey.FileName }
-	errCanceled              = errors.New("canceled")
 	errEmpty                 = errors.New("empty key")
 	errBadKey                = errors.New("bad key")
 	errImportDirectory       = errors.New("can't import a directory")
 )
 
+// ErrReadOnly is returned by methods that would change a store opened with
+// Options.ReadOnly.
+var ErrReadOnly = errors.New("store is read-only")
+
 type TransformFunction func(s string) []string
 
 type AdvancedTransformFunction func(s string) *PathKey
@@ -45,13 +55,41 @@ type Options struct {
 	Transform         TransformFunction
 	AdvancedTransform AdvancedTransformFunction
 	InverseTransform  InverseTransformFunction
+	// CacheSizeMax bounds the bytes held in the cache. Those are the bytes
+	// as stored on disk, so compressed, unless CacheDecompressed is set, in
+	// which case they are the decompressed value.
 	CacheSizeMax      uint64
+	CacheDecompressed bool
 	PathPerm          os.FileMode
 	FilePerm          os.FileMode
-	TempDir           string
-	Index             Index
-	IndexLess         LessFunction
-	Compression       Compression
+	// TempDir, if set, is where values are written before being renamed
+	// into place, in place of the staging directory under BasePath. See
+	// SweepStaging for removing what crashed writes leave there.
+	TempDir     string
+	Index       Index
+	IndexLess   LessFunction
+	IndexAsync  bool
+	Compression Compression
+	// CompressionFor, if set, picks the Compression per key in place of
+	// Compression; returning nil stores the key's values raw.
+	CompressionFor func(key string) Compression
+	// CompressionSample, if positive, is how many leading bytes of each
+	// value are test-compressed; values whose sample does not shrink below
+	// CompressionMaxRatio (0.9 by default) of its size are stored raw.
+	CompressionSample   int
+	CompressionMaxRatio float64
+	// ArchiveMetadata makes Export record the modification time and mode
+	// of each value's file, which ImportArchive then restores.
+	ArchiveMetadata bool
+	// ArchiveProgress, if set, is called by Export and ImportArchive after
+	// each value.
+	ArchiveProgress ArchiveProgress
+	// FileSystem holds the store; nil means the operating system's.
+	FileSystem FS
+	// ReadOnly makes every method that would change the store return
+	// ErrReadOnly, so that nothing under BasePath or TempDir is ever
+	// created, written or removed.
+	ReadOnly bool
 }
 
 type Diskv struct {
@@ -59,6 +97,22 @@ type Diskv struct {
 	mu        sync.RWMutex
 	cache     map[string][]byte
 	cacheSize uint64
+	cacheGen  uint64
+	secondary map[string]*secondaryIndex
+	journals  map[string]bool // persisted secondary indexes; nil until listed
+	replicas  []*Replicator
+	keysGen   uint64 // bumped whenever a key may have come or gone
+	snapshots []*snapshot
+
+	dictMu   sync.RWMutex           // guards dicts and dictErrs; taken without mu
+	dicts    map[uint32]*Dictionary // the store's dictionaries, by ID
+	dictErrs map[uint32]error       // met loading dictionaries, by ID
+	dictsErr error                  // met listing the dictionaries
+
+	indexState   IndexState
+	indexDone    chan struct{}
+	indexErr     error
+	indexPending []indexOp
 }
 
 func New(o Options) *Diskv {
@@ -87,6 +141,12 @@ func New(o Options) *Diskv {
 	if o.FilePerm == 0 {
 		o.FilePerm = defaultFilePerm
 	}
+	if o.FileSystem == nil {
+		o.FileSystem = NewOSFS()
+	}
+	if o.CompressionSample > 0 && o.CompressionMaxRatio == 0 {
+		o.CompressionMaxRatio = defaultCompressionMaxRatio
+	}
 
 	d := &Diskv{
 		Options:   o,
@@ -94,8 +154,16 @@ func New(o Options) *Diskv {
 		cacheSize: 0,
 	}
 
+	d.loadDictionaries()
+
 	if d.Index != nil && d.IndexLess != nil {
-		d.Index.Initialize(d.IndexLess, d.Keys(nil))
+		d.indexState = IndexBuilding
+		d.indexDone = make(chan struct{})
+		if d.IndexAsync {
+			go d.buildIndex()
+		} else {
+			d.buildIndex()
+		}
 	}
 
 	return d
@@ -122,113 +190,216 @@ func (d *Diskv) transform(key string) (pathKey *PathKey) {
 }
 
 func (d *Diskv) WriteStream(key string, r io.Reader, sync bool) error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
 	if len(key) <= 0 {
 		return errEmpty
 	}
 
 	pathKey := d.transform(key)
+	if err := d.validateKey(pathKey); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
+	return d.writeStreamWithLock(pathKey, r, d.compressionFor(key), sync)
+}
+
+func (d *Diskv) validateKey(pathKey *PathKey) error {
 	for _, pathPart := range pathKey.Path {
 		if strings.ContainsRune(pathPart, os.PathSeparator) {
 			return errBadKey
 		}
 	}
 
-	if strings.ContainsRune(pathKey.FileName, os.PathListSeparator) {
+	if strings.ContainsRune(pathKey.FileName, os.PathSeparator) {
 		return errBadKey
 	}
 
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	relPath := filepath.Join(filepath.Join(pathKey.Path...), pathKey.FileName)
+	if strings.SplitN(relPath, string(os.PathSeparator), 2)[0] == metaDir {
+		return errBadKey
+	}
+	return nil
+}
 
-	return d.writeStreamWithLock(pathKey, r, sync)
+// compressionFor returns the Compression configured for values of key.
+func (d *Diskv) compressionFor(key string) Compression {
+	if d.CompressionFor != nil {
+		return d.CompressionFor(key)
+	}
+	return d.Compression
 }
 
-func (d *Diskv) createKeyFileWithLock(pathKey *PathKey) (*os.File, error) {
+// createKeyFileWithLock creates the temporary file a value is written into
+// before being renamed into place: in TempDir if set, else under BasePath,
+// where key enumeration does not look. A value is thus never seen half
+// written, and readers of the old value and hard links to it made by Clone
+// are left intact.
+func (d *Diskv) createKeyFileWithLock(pathKey *PathKey) (File, error) {
+	tempDir := d.TempDir
+	if tempDir == "" {
+		tempDir = d.stagingDir()
+	}
+	if err := d.FileSystem.MkdirAll(tempDir, d.PathPerm); err != nil {
+		return nil, fmt.Errorf("temp mkdir: %s", err)
+	}
+	f, err := d.FileSystem.TempFile(tempDir, stagingPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("temp file: %s", err)
+	}
+
+	if err := d.FileSystem.Chmod(f.Name(), d.FilePerm); err != nil {
+		f.Close()
+		d.FileSystem.Remove(f.Name())
+		return nil, fmt.Errorf("chomod: %s", err)
+	}
+	return f, nil
+}
+
+// SweepStaging removes the temporary files older than age that writes
+// which never finished, as when the process writing crashed, left in TempDir
+// or the staging directory under BasePath. Only files named as the store
+// names them are removed, and younger ones are left alone, since a write by
+// this or another process may still be under way: age should be well over
+// the time the slowest write takes.
+func (d *Diskv) SweepStaging(age time.Duration) error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
+	dirs := []string{d.stagingDir()}
 	if d.TempDir != "" {
-		if err := os.MkdirAll(d.TempDir, d.PathPerm); err != nil {
-			return nil, fmt.Errorf("temp mkdir: %s", err)
+		dirs = append(dirs, d.TempDir)
+	}
+	for _, dir := range dirs {
+		entries, err := d.FileSystem.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
 		}
-		f, err := ioutil.TempFile(d.TempDir, "")
 		if err != nil {
-			return nil, fmt.Errorf("temp file: %s", err)
+			return err
 		}
-
-		if err := os.Chmod(f.Name(), d.FilePerm); err != nil {
-			f.Close()
-			os.Remove(f.Name())
-			return nil, fmt.Errorf("chomod: %s", err)
+		for _, e := range entries {
+			if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), stagingPrefix) {
+				continue
+			}
+			fi, err := e.Info()
+			if err != nil || time.Since(fi.ModTime()) < age {
+				continue
+			}
+			err = d.FileSystem.Remove(filepath.Join(dir, e.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
 		}
-		return f, nil
 	}
-	mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
-	f, err := os.OpenFile(d.completeFilename(pathKey), mode, d.FilePerm)
-	if err != nil {
-		return nil, fmt.Errorf("open file: %s", err)
-	}
-	return f, nil
+	return nil
 }
 
-func (d *Diskv) writeStreamWithLock(pathKey *PathKey, r io.Reader, sync bool) error {
-	if err := d.ensurePathWithLock(pathKey); err != nil {
-		return fmt.Errorf("ensure path: %s", &err)
+func (d *Diskv) writeStreamWithLock(pathKey *PathKey, r io.Reader, c Compression, sync bool) error {
+	var val *bytes.Buffer
+	if len(d.secondary) > 0 {
+		val = &bytes.Buffer{}
+		r = io.TeeReader(r, val)
 	}
 
-	f, err := d.createKeyFileWithLock(pathKey)
-	if err != nil {
-		return fmt.Errorf("create key file: %s", err)
+	if c == nil {
+		r, c = escapeRaw(r)
+	} else if d.CompressionSample > 0 {
+		r, c = sampleCompression(r, c, d.CompressionSample, d.CompressionMaxRatio)
+	}
+	if dc, ok := c.(*dictCodec); ok {
+		if err := d.saveDictionaryWithLock(dc.dict); err != nil {
+			return fmt.Errorf("save dictionary: %s", err)
+		}
 	}
 
-	wc := io.WriteCloser(&nopWriteCloser{f})
-	if d.Compression != nil {
-		wc, err = d.Compression.Writer(f)
+	err := d.writeFileWithLock(pathKey, sync, func(f io.Writer) error {
+		wc, err := newValueWriter(f, c)
 		if err != nil {
-			f.Close()
-			os.Remove(f.Name())
 			return fmt.Errorf("compression writer: %s", err)
 		}
+		if _, err := io.Copy(wc, r); err != nil {
+			return fmt.Errorf("i/o copy: %s", err)
+		}
+		if err := wc.Close(); err != nil {
+			return fmt.Errorf("compression close: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	if _, err := io.Copy(wc, r); err != nil {
-		f.Close()
-		os.Remove(f.Name())
-		return fmt.Errorf("i/o copy: %s", err)
+	d.indexInsertWithLock(pathKey.originalKey)
+
+	d.bustCacheWithLock(pathKey.originalKey)
+
+	d.replicateWithLock(pathKey.originalKey, false)
+
+	if val == nil {
+		return d.changedWithLock()
 	}
+	return d.updateSecondaryWithLock(pathKey.originalKey, val.Bytes())
+}
 
-	if err := wc.Close(); err != nil {
+// writeFileWithLock replaces the file of pathKey with what fill writes.
+// On failure the temporary file is removed, along with directories made
+// for the key that are left empty.
+func (d *Diskv) writeFileWithLock(pathKey *PathKey, sync bool, fill func(f io.Writer) error) (err error) {
+	if err := d.ensurePathWithLock(pathKey); err != nil {
+		return fmt.Errorf("ensure path: %s", err)
+	}
+	defer func() {
+		if err != nil {
+			d.pruneDirsWithLock(pathKey.originalKey)
+		}
+	}()
+
+	f, err := d.createKeyFileWithLock(pathKey)
+	if err != nil {
+		return fmt.Errorf("create key file: %s", err)
+	}
+
+	if err := fill(f); err != nil {
 		f.Close()
-		os.Remove(f.Name())
-		return fmt.Errorf("compression close: %s", err)
+		d.FileSystem.Remove(f.Name())
+		return err
 	}
 
 	if sync {
 		if err := f.Sync(); err != nil {
 			f.Close()
-			os.Remove(f.Name())
+			d.FileSystem.Remove(f.Name())
 			return fmt.Errorf("file sync: %s", err)
 		}
 	}
 
 	if err := f.Close(); err != nil {
+		d.FileSystem.Remove(f.Name())
 		return fmt.Errorf("file close: %s", err)
 	}
 
-	fullPath := d.completeFilename(pathKey)
-	if f.Name() != fullPath {
-		if err := os.Rename(f.Name(), fullPath); err != nil {
-			os.Remove(f.Name())
-			return fmt.Errorf("rename: %s", err)
-		}
-	}
-	if d.Index != nil {
-		d.Index.Insert(pathKey.originalKey)
+	d.preserveWithLock(pathKey.originalKey)
+	if err := d.FileSystem.Rename(f.Name(), d.completeFilename(pathKey)); err != nil {
+		d.FileSystem.Remove(f.Name())
+		return fmt.Errorf("rename: %s", err)
 	}
-
-	d.bustCacheWithLock(pathKey.originalKey)
 	return nil
 }
 
+// Import stores the file srcFilename under dstKey. Import sources are host
+// files, read with the os package whatever the store's FileSystem. With
+// move, the file is removed once imported; it is renamed into place when
+// the store is on the OS file system and neither compresses nor indexes
+// the value.
 func (d *Diskv) Import(srcFilename, dstKey string, move bool) (err error) {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
 	if dstKey == "" {
 		return errEmpty
 	}
@@ -240,19 +411,70 @@ func (d *Diskv) Import(srcFilename, dstKey string, move bool) (err error) {
 	}
 
 	dstPathKey := d.transform(dstKey)
+	if err := d.validateKey(dstPathKey); err != nil {
+		return err
+	}
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	return d.importWithLock(srcFilename, dstPathKey, move)
+}
+
+// ImportDir imports every regular file below the host directory srcDir,
+// as Import does. keyFunc maps each
+// file's slash-separated path relative to srcDir to its key; files it maps
+// to "" are skipped. A nil keyFunc uses the relative path as the key.
+func (d *Diskv) ImportDir(srcDir string, keyFunc func(relPath string) string, move bool) error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
+	if keyFunc == nil {
+		keyFunc = func(relPath string) string { return relPath }
+	}
+
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		key := keyFunc(filepath.ToSlash(relPath))
+		if key == "" {
+			return nil
+		}
+		if err := d.Import(path, key, move); err != nil {
+			return fmt.Errorf("import %s: %s", path, err)
+		}
+		return nil
+	})
+}
+
+func (d *Diskv) importWithLock(srcFilename string, dstPathKey *PathKey, move bool) error {
 	if err := d.ensurePathWithLock(dstPathKey); err != nil {
 		return fmt.Errorf("ensure path: %s", err)
 	}
 
-	if move {
-		if err := syscall.Rename(srcFilename, d.completeFilename(dstPathKey)); err == nil {
+	c := d.compressionFor(dstPathKey.originalKey)
+	_, onOS := d.FileSystem.(osFS)
+	if move && onOS && c == nil && len(d.secondary) == 0 && !fileNeedsRawHeader(srcFilename) {
+		dstFilename := d.completeFilename(dstPathKey)
+		d.preserveWithLock(dstPathKey.originalKey)
+		if err := d.FileSystem.Rename(srcFilename, dstFilename); err == nil {
+			if err := d.FileSystem.Chmod(dstFilename, d.FilePerm); err != nil {
+				return fmt.Errorf("chmod: %s", err)
+			}
+			d.indexInsertWithLock(dstPathKey.originalKey)
 			d.bustCacheWithLock(dstPathKey.originalKey)
-			return nil
-		} else if err != syscall.EXDEV {
+			d.replicateWithLock(dstPathKey.originalKey, false)
+			return d.changedWithLock()
+		} else if !errors.Is(err, syscall.EXDEV) {
 			return err
 		}
 	}
@@ -262,7 +484,7 @@ func (d *Diskv) Import(srcFilename, dstKey string, move bool) (err error) {
 		return err
 	}
 	defer f.Close()
-	err = d.writeStreamWithLock(dstPathKey, f, false)
+	err = d.writeStreamWithLock(dstPathKey, f, c, false)
 	if err == nil && move {
 		err = os.Remove(srcFilename)
 	}
@@ -286,13 +508,14 @@ func (d *Diskv) ReadString(key string) string {
 func (d *Diskv) ReadStream(key string, direct bool) (io.ReadCloser, error) {
 	pathKey := d.transform(key)
 	d.mu.Lock()
-	defer d.mu.Unlock()
+	legacy := d.compressionFor(key)
 
 	if val, ok := d.cache[key]; ok {
 		if !direct {
+			d.mu.Unlock()
 			buf := bytes.NewReader(val)
-			if d.Compression != nil {
-				return d.Compression.Reader(buf)
+			if !d.CacheDecompressed {
+				return d.newValueReader(buf, legacy)
 			}
 			return ioutil.NopCloser(buf), nil
 		}
@@ -303,14 +526,24 @@ func (d *Diskv) ReadStream(key string, direct bool) (io.ReadCloser, error) {
 			d.uncacheWithLock(key, uint64(len(val)))
 		}()
 	}
+	gen := d.cacheGen
+	d.mu.Unlock()
 
-	return d.readWithRLock(pathKey)
+	var s *siphon
+	if d.CacheSizeMax > 0 {
+		s = &siphon{d: d, key: key, gen: gen, buf: &bytes.Buffer{}}
+	}
+	return d.readValue(pathKey, legacy, s)
 }
 
-func (d *Diskv) readWithRLock(pathKey *PathKey) (io.ReadCloser, error) {
+// readValue opens the value for pathKey, decoding it as d.newValueReader does
+// with legacy. It needs no lock, since values are replaced by rename. When s
+// is non-nil the value is siphoned into the cache: as stored on disk, or
+// decoded if CacheDecompressed is set.
+func (d *Diskv) readValue(pathKey *PathKey, legacy Compression, s *siphon) (io.ReadCloser, error) {
 	filename := d.completeFilename(pathKey)
 
-	fi, err := os.Stat(filename)
+	fi, err := d.FileSystem.Stat(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -318,97 +551,180 @@ func (d *Diskv) readWithRLock(pathKey *PathKey) (io.ReadCloser, error) {
 		return nil, os.ErrNotExist
 	}
 
-	f, err := os.Open(filename)
+	f, err := openFile(d.FileSystem, filename)
 	if err != nil {
 		return nil, err
 	}
 
-	var r io.Reader
-	if d.CacheSizeMax > 0 {
-		r = newSiphon(f, d, pathKey.originalKey)
-	} else {
-		r = &closingReader{f}
+	rc := io.ReadCloser(&closingReader{rc: f})
+	if s != nil && !d.CacheDecompressed {
+		s.rc, rc = rc, s
 	}
-
-	var rc = io.ReadCloser(ioutil.NopCloser(r))
-	if d.Compression != nil {
-		rc, err = d.Compression.Reader(r)
-		if err != nil {
-			return nil, err
-		}
+	zr, err := d.newValueReader(rc, legacy)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	rc = &decompressingReader{zr: zr, src: rc}
+	if s != nil && d.CacheDecompressed {
+		s.rc, rc = rc, s
 	}
 	return rc, nil
 }
 
 type closingReader struct {
-	rc io.ReadCloser
+	rc     io.ReadCloser
+	closed bool
 }
 
-func (cr closingReader) Read(p []byte) (int, error) {
+func (cr *closingReader) Read(p []byte) (int, error) {
+	if cr.closed {
+		return 0, io.EOF
+	}
 	n, err := cr.rc.Read(p)
 
 	if err == io.EOF {
-		if closeErr := cr.rc.Close(); closeErr != nil {
+		if closeErr := cr.Close(); closeErr != nil {
 			return n, closeErr
 		}
 	}
 	return n, err
 }
 
+func (cr *closingReader) Close() error {
+	if cr.closed {
+		return nil
+	}
+	cr.closed = true
+	return cr.rc.Close()
+}
+
+type decompressingReader struct {
+	zr  io.ReadCloser
+	src io.ReadCloser
+}
+
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	n, err := r.zr.Read(p)
+	if err == io.EOF {
+		// Drain the source so a siphon beneath sees EOF as well.
+		io.Copy(ioutil.Discard, r.src)
+	}
+	return n, err
+}
+
+func (r *decompressingReader) Close() error {
+	zerr := r.zr.Close()
+	if err := r.src.Close(); err != nil {
+		return err
+	}
+	return zerr
+}
+
+// fileNeedsRawHeader is needsRawHeader for the host file filename, which
+// cannot then be moved into place as it is.
+func fileNeedsRawHeader(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	p := make([]byte, len(codecMagic))
+	n, _ := io.ReadFull(f, p)
+	return needsRawHeader(p[:n])
+}
+
+// Recompress rewrites every value in the store with c. Values are decoded
+// with whatever codec wrote them. The store's Compression, which is read
+// without locking, is left as it is: reopen the store with c for values
+// written from then on to use it too.
+func (d *Diskv) Recompress(ctx context.Context, c Codec) error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
+	legacy := d.Compression
+
+	for key, err := range d.walkKeys("") {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		keyLegacy := legacy
+		if d.CompressionFor != nil {
+			keyLegacy = d.CompressionFor(key)
+		}
+		if err := d.recompress(d.transform(key), keyLegacy, c); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("recompress %s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+func (d *Diskv) recompress(pathKey *PathKey, legacy Compression, c Codec) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rc, err := d.readValue(pathKey, legacy, nil)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return d.writeStreamWithLock(pathKey, rc, c, false)
+}
+
 func (d *Diskv) ensurePathWithLock(pathKey *PathKey) error {
-	return os.MkdirAll(d.pathFor(pathKey), d.PathPerm)
+	return d.FileSystem.MkdirAll(d.pathFor(pathKey), d.PathPerm)
 }
 
 type siphon struct {
-	f   *os.File
+	rc  io.ReadCloser
 	d   *Diskv
 	key string
+	gen uint64
 	buf *bytes.Buffer
 }
 
-func newSiphon(f *os.File, d *Diskv, key string) io.Reader {
-	return &siphon{
-		f:   f,
-		d:   d,
-		key: key,
-		buf: &bytes.Buffer{},
-	}
-}
-
 func (s *siphon) Read(p []byte) (int, error) {
-	n, err := s.f.Read(p)
-
-	if err == nil {
-		return s.buf.Write(p[0:n])
-	}
+	n, err := s.rc.Read(p)
+	s.buf.Write(p[0:n])
 
 	if err == io.EOF {
-		s.d.cacheWithoutLock(s.key, s.buf.Bytes())
-		if closerErr := s.f.Close(); closerErr != nil {
+		s.d.cacheWithoutLock(s.key, s.gen, s.buf.Bytes())
+		if closerErr := s.rc.Close(); closerErr != nil {
 			return n, closerErr
 		}
-		return n, err
 	}
 	return n, err
 }
 
+func (s *siphon) Close() error {
+	return s.rc.Close()
+}
+
 func (d *Diskv) Erase(key string) error {
-	pathKey := d.transform(key)
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	return d.eraseWithLock(key)
+}
 
+func (d *Diskv) eraseWithLock(key string) error {
+	pathKey := d.transform(key)
 	d.bustCacheWithLock(key)
 
-	if d.Index != nil {
-		d.Index.Delete(key)
-	}
+	d.indexDeleteWithLock(key)
 
 	filename := d.completeFilename(pathKey)
-	if s, err := os.Stat(filename); err == nil {
+	if s, err := d.FileSystem.Stat(filename); err == nil {
 		if s.IsDir() {
 			return errBadKey
 		}
-		if err = os.RemoveAll(filename); err != nil {
+		d.preserveWithLock(key)
+		if err = d.FileSystem.RemoveAll(filename); err != nil {
 			return err
 		}
 	} else {
@@ -416,31 +732,46 @@ func (d *Diskv) Erase(key string) error {
 	}
 
 	d.pruneDirsWithLock(key)
-	return nil
+	d.replicateWithLock(key, false)
+	return d.removeSecondaryWithLock(key)
 }
 
 func (d *Diskv) EraseAll() error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	d.preserveAllWithLock()
 	d.cache = make(map[string][]byte)
 	d.cacheSize = 0
+	d.cacheGen++
+	d.keysGen++
+	d.dictMu.Lock()
+	d.dicts, d.dictErrs, d.dictsErr = map[uint32]*Dictionary{}, map[uint32]error{}, nil
+	d.dictMu.Unlock()
+	for _, si := range d.secondary {
+		si.reset()
+	}
+	d.journals = nil
+	d.replicateWithLock("", true)
 	if d.TempDir != "" {
-		os.RemoveAll(d.TempDir)
+		d.FileSystem.RemoveAll(d.TempDir)
 	}
-	return os.RemoveAll(d.BasePath)
+	return d.FileSystem.RemoveAll(d.BasePath)
 }
 
 func (d *Diskv) Has(key string) bool {
 	pathKey := d.transform(key)
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
 	if _, ok := d.cache[key]; ok {
 		return true
 	}
 
 	filename := d.completeFilename(pathKey)
-	s, err := os.Stat(filename)
+	s, err := d.FileSystem.Stat(filename)
 	if err != nil {
 		return false
 	}
@@ -456,28 +787,131 @@ func (d *Diskv) Keys(cancel <-chan struct{}) <-chan string {
 }
 
 func (d *Diskv) KeysPrefix(prefix string, cancel <-chan struct{}) <-chan string {
-	var prepath string
-	if prefix == "" {
-		prepath = d.BasePath
-	} else {
-		prefixKey := d.transform(prefix)
-		prepath = d.pathFor(prefixKey)
+	return keysChan(d.KeysSeq(prefix), cancel)
+}
+
+// KeysSeq yields every key beginning with prefix in sorted order: IndexLess
+// order when an Index is configured, lexical order otherwise. Errors met
+// while walking BasePath are yielded with an empty key and end the sequence.
+func (d *Diskv) KeysSeq(prefix string) iter.Seq2[string, error] {
+	return d.keysAfter(prefix, "")
+}
+
+// keysAfter is KeysSeq starting after the key after. Until the Index is
+// ready it walks BasePath, sorting what it finds as the Index would, so
+// that pages taken before and after the Index is built agree.
+func (d *Diskv) keysAfter(prefix, after string) iter.Seq2[string, error] {
+	if d.IndexState() == IndexReady {
+		return d.indexKeys(prefix, after)
+	}
+	less := d.keyLess()
+	return func(yield func(string, error) bool) {
+		keys := []string{}
+		for key, err := range d.walkKeys(prefix) {
+			if err != nil {
+				yield("", err)
+				return
+			}
+			if after == "" || less(after, key) {
+				keys = append(keys, key)
+			}
+		}
+		if d.Index != nil && d.IndexLess != nil {
+			sort.SliceStable(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+		}
+		for _, key := range keys {
+			if !yield(key, nil) {
+				return
+			}
+		}
+	}
+}
+
+// keyLess is the order keys are listed in.
+func (d *Diskv) keyLess() LessFunction {
+	if d.Index != nil && d.IndexLess != nil {
+		return d.IndexLess
+	}
+	return func(a, b string) bool { return a < b }
+}
+
+func (d *Diskv) indexKeys(prefix, from string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		for {
+			keys := d.Index.Keys(from, indexPageSize)
+			for _, key := range keys {
+				if strings.HasPrefix(key, prefix) && !yield(key, nil) {
+					return
+				}
+			}
+			if len(keys) < indexPageSize {
+				return
+			}
+			from = keys[len(keys)-1]
+		}
 	}
+}
+
+func (d *Diskv) walkKeys(prefix string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		keys := []string{}
+		err := d.FileSystem.Walk(d.BasePath, d.walker(prefix, func(key string) {
+			keys = append(keys, key)
+		}))
+		if err != nil {
+			yield("", err)
+			return
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !yield(key, nil) {
+				return
+			}
+		}
+	}
+}
+
+func keysChan(seq iter.Seq2[string, error], cancel <-chan struct{}) <-chan string {
 	c := make(chan string)
 	go func() {
-		filepath.Walk(prepath, d.walker(c, prefix, cancel))
-		close(c)
+		defer close(c)
+		for key, err := range seq {
+			if err != nil {
+				return
+			}
+			select {
+			case c <- key:
+			case <-cancel:
+				return
+			}
+		}
 	}()
 	return c
 }
 
-func (d *Diskv) walker(c chan<- string, prefix string, cancel <-chan struct{}) filepath.WalkFunc {
+func (d *Diskv) walker(prefix string, fn func(key string)) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
 			return err
 		}
 
-		relPath, _ := filepath.Rel(d.BasePath, path)
+		if info.IsDir() {
+			if filepath.Clean(path) == filepath.Join(d.BasePath, metaDir) {
+				return filepath.SkipDir
+			}
+			if d.TempDir != "" && filepath.Clean(path) == filepath.Clean(d.TempDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		relPath, err := filepath.Rel(d.BasePath, path)
+		if err != nil {
+			return err
+		}
 		dir, file := filepath.Split(relPath)
 		pathSplit := strings.Split(dir, string(filepath.Separator))
 		pathSplit = pathSplit[:len(pathSplit)-1]
@@ -487,18 +921,9 @@ func (d *Diskv) walker(c chan<- string, prefix string, cancel <-chan struct{}) f
 			FileName: file,
 		}
 
-		key := d.InverseTransform(pathKey)
-
-		if info.IsDir() || !strings.HasPrefix(key, prefix) {
-			return nil
-		}
-
-		select {
-		case c <- key:
-		case <-cancel:
-			return errCanceled
+		if key := d.InverseTransform(pathKey); strings.HasPrefix(key, prefix) {
+			fn(key)
 		}
-
 		return nil
 	}
 }
@@ -528,13 +953,17 @@ func (d *Diskv) cacheWithLock(key string, val []byte) error {
 	return nil
 }
 
-func (d *Diskv) cacheWithoutLock(key string, val []byte) error {
+func (d *Diskv) cacheWithoutLock(key string, gen uint64, val []byte) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	if gen != d.cacheGen {
+		return nil
+	}
 	return d.cacheWithLock(key, val)
 }
 
 func (d *Diskv) bustCacheWithLock(key string) {
+	d.cacheGen++
 	if val, ok := d.cache[key]; ok {
 		d.uncacheWithLock(key, uint64(len(val)))
 	}
@@ -550,20 +979,20 @@ func (d *Diskv) pruneDirsWithLock(key string) error {
 	for i := range pathList {
 		dir := filepath.Join(d.BasePath, filepath.Join(pathList[:len(pathList)-i]...))
 
-		switch fi, err := os.Stat(dir); true {
+		switch fi, err := d.FileSystem.Stat(dir); true {
 		case err != nil:
 			return err
 		case !fi.IsDir():
 			panic(fmt.Sprintf("corrupt dirstate at %s", dir))
 		}
 
-		nlinks, err := filepath.Glob(filepath.Join(dir, "*"))
+		nlinks, err := d.FileSystem.ReadDir(dir)
 		if err != nil {
 			return err
 		} else if len(nlinks) > 0 {
 			return nil
 		}
-		if err = os.Remove(dir); err != nil {
+		if err = d.FileSystem.Remove(dir); err != nil {
 			return err
 		}
 	}
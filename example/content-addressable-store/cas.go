@@ -50,7 +50,7 @@ func main() {
 		fmt.Printf("%s: %s\n", key, val)
 		keyCount++
 	}
-	fmt.Sprintf("%d total keys\n", keyCount)
+	fmt.Printf("%d total keys\n", keyCount)
 }
 
 func md5sum(s string) string {
@@ -0,0 +1,332 @@
+package studydiskv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var errCrashed = errors.New("simulated crash")
+
+// faultFS wraps an FS, failing the operations its faults match. A fault
+// that crashes makes that and every later operation fail, leaving the
+// wrapped FS as a restarted process would find it.
+type faultFS struct {
+	FS
+	mu      sync.Mutex
+	faults  []*fault
+	crashed bool
+}
+
+type fault struct {
+	op      string // method name, such as "Rename" or, on Files, "Write"
+	path    string // substring the path must contain; "" matches any
+	skip    int    // matching calls to let through first
+	err     error
+	crash   bool
+	partial int // for Write: bytes written before failing
+}
+
+func newFaultFS(fsys FS) *faultFS {
+	return &faultFS{FS: fsys}
+}
+
+func (f *faultFS) inject(flt *fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, flt)
+}
+
+func (f *faultFS) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults, f.crashed = nil, false
+}
+
+// check returns the fault hitting op on path, if any.
+func (f *faultFS) check(op, path string) (*fault, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return nil, errCrashed
+	}
+	for _, flt := range f.faults {
+		if flt.op != op || !strings.Contains(path, flt.path) {
+			continue
+		}
+		if flt.skip > 0 {
+			flt.skip--
+			continue
+		}
+		if flt.crash {
+			f.crashed = true
+			return flt, errCrashed
+		}
+		return flt, flt.err
+	}
+	return nil, nil
+}
+
+func (f *faultFS) wrap(file File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *faultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if _, err := f.check("OpenFile", name); err != nil {
+		return nil, err
+	}
+	return f.wrap(f.FS.OpenFile(name, flag, perm))
+}
+
+func (f *faultFS) TempFile(dir, pattern string) (File, error) {
+	if _, err := f.check("TempFile", dir); err != nil {
+		return nil, err
+	}
+	return f.wrap(f.FS.TempFile(dir, pattern))
+}
+
+func (f *faultFS) Rename(oldpath, newpath string) error {
+	if _, err := f.check("Rename", newpath); err != nil {
+		return err
+	}
+	return f.FS.Rename(oldpath, newpath)
+}
+
+func (f *faultFS) Link(oldname, newname string) error {
+	if _, err := f.check("Link", newname); err != nil {
+		return err
+	}
+	return f.FS.Link(oldname, newname)
+}
+
+func (f *faultFS) MkdirAll(path string, perm os.FileMode) error {
+	if _, err := f.check("MkdirAll", path); err != nil {
+		return err
+	}
+	return f.FS.MkdirAll(path, perm)
+}
+
+func (f *faultFS) Remove(name string) error {
+	if _, err := f.check("Remove", name); err != nil {
+		return err
+	}
+	return f.FS.Remove(name)
+}
+
+func (f *faultFS) Chmod(name string, mode os.FileMode) error {
+	if _, err := f.check("Chmod", name); err != nil {
+		return err
+	}
+	return f.FS.Chmod(name, mode)
+}
+
+type faultFile struct {
+	File
+	fs *faultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	flt, err := f.fs.check("Write", f.Name())
+	if err == nil {
+		return f.File.Write(p)
+	}
+	n := 0
+	if flt != nil && flt.partial > 0 {
+		n, _ = f.File.Write(p[:min(flt.partial, len(p))])
+	}
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	if _, err := f.fs.check("Sync", f.Name()); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Close() error {
+	if _, err := f.fs.check("Close", f.Name()); err != nil {
+		f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
+
+// listFiles returns the regular files below root.
+func listFiles(t *testing.T, fsys FS, root string) []string {
+	files := []string{}
+	err := fsys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, filepath.ToSlash(path))
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestWriteFaults(t *testing.T) {
+	oldVal := []byte("the old value")
+	newVal := bytes.Repeat([]byte("the new value, longer than any buffer "), 4096)
+
+	for _, c := range []Compression{nil, NewGzipCompression()} {
+		for _, flt := range []fault{
+			{op: "MkdirAll", err: syscall.EIO},
+			{op: "TempFile", err: syscall.ENOSPC},
+			{op: "Chmod", err: syscall.EPERM},
+			{op: "Write", err: syscall.ENOSPC},
+			{op: "Write", skip: 1, partial: 100, err: syscall.ENOSPC},
+			{op: "Sync", err: syscall.EIO},
+			{op: "Close", err: syscall.EIO},
+			{op: "Rename", err: syscall.EIO},
+			{op: "Write", skip: 1, partial: 100, crash: true},
+			{op: "Sync", crash: true},
+			{op: "Close", crash: true},
+			{op: "Rename", crash: true},
+		} {
+			name := fmt.Sprintf("%s/codec %v", flt.op, c != nil)
+			if flt.crash {
+				name += "/crash"
+			}
+			t.Run(name, func(t *testing.T) {
+				mem := NewMemFS()
+				ffs := newFaultFS(mem)
+				opts := Options{
+					BasePath:     "test-faults",
+					Transform:    func(s string) []string { return []string{s[:1]} },
+					CacheSizeMax: 1 << 20,
+					Compression:  c,
+					Index:        &BTreeIndex{},
+					IndexLess:    strLess,
+					FileSystem:   ffs,
+				}
+				d := New(opts)
+				if err := d.Write("old", oldVal); err != nil {
+					t.Fatal(err)
+				}
+				d.Read("old") // cache it
+				before := listFiles(t, mem, "test-faults")
+
+				for _, key := range []string{"old", "new"} {
+					flt := flt
+					ffs.inject(&flt)
+					if err := d.WriteStream(key, bytes.NewReader(newVal), true); err == nil {
+						t.Fatalf("%s: write succeeded", key)
+					}
+					if !flt.crash {
+						ffs.reset()
+					}
+				}
+
+				// The store as a restarted process finds it.
+				opts.FileSystem, opts.Index = mem, &BTreeIndex{}
+				for _, s := range []*Diskv{d, New(opts)} {
+					if flt.crash && s == d {
+						continue
+					}
+					if val, err := s.Read("old"); err != nil || !bytes.Equal(val, oldVal) {
+						t.Errorf("old: have %.20q, %v", val, err)
+					}
+					if s.Has("new") {
+						t.Errorf("new: partial value visible")
+					}
+					if keys := collectKeys(t, s, ""); !cmpStrings(keys, []string{"old"}) {
+						t.Errorf("keys: have %v", keys)
+					}
+				}
+
+				// Temporary files a crash left behind are swept once no
+				// write can still be under way.
+				if err := New(opts).SweepStaging(0); err != nil {
+					t.Fatal(err)
+				}
+				if after := listFiles(t, mem, "test-faults"); !cmpStrings(after, before) {
+					t.Errorf("files: want %v, have %v", before, after)
+				}
+				if _, err := mem.Stat(filepath.Join("test-faults", "n")); !os.IsNotExist(err) {
+					t.Errorf("directory for new key left behind")
+				}
+			})
+		}
+	}
+}
+
+func TestSweepStaging(t *testing.T) {
+	mem := NewMemFS()
+	opts := Options{BasePath: "test-sweep", TempDir: "test-sweep-tmp", FileSystem: mem}
+	d := New(opts)
+	d.WriteString("a", "apple")
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{
+		"test-sweep-tmp/diskv-1",
+		"test-sweep-tmp/diskv-2",
+		"test-sweep-tmp/other",
+		"test-sweep-tmp/diskv-dir/diskv-3",
+		"test-sweep/.diskv/tmp/diskv-4",
+		"test-sweep/.diskv/tmp/diskv-5",
+	} {
+		if err := writeFileAtomic(mem, name, 0755, 0644, func(w io.Writer) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(name, "2") && !strings.HasSuffix(name, "5") {
+			mem.Chtimes(name, old, old)
+		}
+	}
+
+	// Opening the store leaves them, as writes may be under way.
+	New(opts)
+	if files := listFiles(t, mem, "test-sweep-tmp"); len(files) != 4 {
+		t.Errorf("swept on opening: have %v", files)
+	}
+
+	opts.ReadOnly = true
+	if err := New(opts).SweepStaging(time.Minute); err != ErrReadOnly {
+		t.Errorf("read-only: want %v, have %v", ErrReadOnly, err)
+	}
+
+	if err := d.SweepStaging(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"test-sweep-tmp/diskv-2", "test-sweep-tmp/diskv-dir/diskv-3", "test-sweep-tmp/other"}
+	if have := listFiles(t, mem, "test-sweep-tmp"); !cmpStrings(have, want) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	want = []string{"test-sweep/.diskv/tmp/diskv-5", "test-sweep/a"}
+	if have := listFiles(t, mem, "test-sweep"); !cmpStrings(have, want) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if d.ReadString("a") != "apple" {
+		t.Errorf("value lost")
+	}
+}
+
+func TestFaultFSCrash(t *testing.T) {
+	ffs := newFaultFS(NewMemFS())
+	ffs.inject(&fault{op: "Rename", crash: true})
+	if err := ffs.Rename("a", "b"); err != errCrashed {
+		t.Errorf("want %v, have %v", errCrashed, err)
+	}
+	if err := ffs.MkdirAll("x", 0755); err != errCrashed {
+		t.Errorf("after crash: want %v, have %v", errCrashed, err)
+	}
+	ffs.reset()
+	if err := ffs.MkdirAll("x", 0755); err != nil {
+		t.Errorf("after reset: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package studydiskv
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FS is the file system a Diskv keeps its values in. Its methods behave as
+// their namesakes in package os; TempFile as ioutil.TempFile and Walk as
+// filepath.Walk.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	TempFile(dir, pattern string) (File, error)
+	Rename(oldpath, newpath string) error
+	Link(oldname, newname string) error
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Stat(name string) (os.FileInfo, error)
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	ReadDir(name string) ([]os.DirEntry, error)
+	Walk(root string, fn filepath.WalkFunc) error
+}
+
+// File is an open file of an FS.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// NewOSFS returns the FS of the operating system, which a Diskv uses when
+// Options.FileSystem is nil.
+func NewOSFS() FS {
+	return osFS{}
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) TempFile(dir, pattern string) (File, error) {
+	f, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
+
+func openFile(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func readFile(fsys FS, name string) ([]byte, error) {
+	f, err := openFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// writeFileAtomic writes filename, with permissions filePerm, through a
+// temporary file beside it, making its directory with pathPerm if needed.
+func writeFileAtomic(fsys FS, filename string, pathPerm, filePerm os.FileMode, fill func(f io.Writer) error) error {
+	if err := fsys.MkdirAll(filepath.Dir(filename), pathPerm); err != nil {
+		return err
+	}
+	f, err := fsys.TempFile(filepath.Dir(filename), ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := fsys.Chmod(f.Name(), filePerm); err != nil {
+		f.Close()
+		fsys.Remove(f.Name())
+		return err
+	}
+	if err := fill(f); err != nil {
+		f.Close()
+		fsys.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		fsys.Remove(f.Name())
+		return err
+	}
+	if err := fsys.Rename(f.Name(), filename); err != nil {
+		fsys.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func linkCount(fi os.FileInfo) uint64 {
+	if mi, ok := fi.(*memInfo); ok {
+		return uint64(mi.nlink)
+	}
+	return sysLinkCount(fi)
+}
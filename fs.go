@@ -0,0 +1,279 @@
+package studydiskv
+
+import (
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS presents the store as a read-only file system: keys, split on "/",
+// are paths of files holding their decompressed values. Keys that are not
+// valid fs paths are left out, as is a key that is also a directory of
+// other keys, in favor of the directory.
+func (d *Diskv) FS() fs.FS {
+	return &keyFS{d: d}
+}
+
+type keyFS struct {
+	d *Diskv
+
+	mu   sync.Mutex
+	gen  uint64   // the store's keysGen when keys was listed
+	keys []string // valid paths among the keys, sorted
+}
+
+var (
+	_ fs.ReadDirFS = (*keyFS)(nil)
+	_ fs.StatFS    = (*keyFS)(nil)
+)
+
+func (kfs *keyFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	isDir, err := kfs.isDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if isDir {
+		entries, err := kfs.readDir(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &keyDir{info: dirInfo(name), entries: entries}, nil
+	}
+
+	if !kfs.isKey(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	h, err := kfs.d.Open(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	info, err := fileInfo(h, name)
+	if err != nil {
+		h.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &keyFile{Handle: h, info: info}, nil
+}
+
+func (kfs *keyFS) Stat(name string) (fs.FileInfo, error) {
+	f, err := kfs.Open(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err.(*fs.PathError).Err}
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (kfs *keyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	isDir, err := kfs.isDir(name)
+	if err == nil && !isDir {
+		err = fs.ErrNotExist
+		if kfs.isKey(name) && kfs.d.Has(name) {
+			err = fs.ErrInvalid
+		}
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries, err := kfs.readDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+func (kfs *keyFS) isKey(name string) bool {
+	return name != "." && kfs.d.validateKey(kfs.d.transform(name)) == nil
+}
+
+// listing returns the keys that are valid paths, in lexical order. It walks
+// the store only when keys have come or gone since the last call.
+func (kfs *keyFS) listing() ([]string, error) {
+	kfs.d.mu.RLock()
+	gen := kfs.d.keysGen
+	kfs.d.mu.RUnlock()
+
+	kfs.mu.Lock()
+	defer kfs.mu.Unlock()
+	if kfs.keys != nil && kfs.gen == gen {
+		return kfs.keys, nil
+	}
+	keys := []string{}
+	for key, err := range kfs.d.KeysSeq("") {
+		if err != nil {
+			return nil, err
+		}
+		if fs.ValidPath(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	kfs.gen, kfs.keys = gen, keys
+	return keys, nil
+}
+
+// below returns the listed keys beginning with prefix.
+func (kfs *keyFS) below(prefix string) ([]string, error) {
+	keys, err := kfs.listing()
+	if err != nil {
+		return nil, err
+	}
+	i := sort.SearchStrings(keys, prefix)
+	j := i
+	for j < len(keys) && strings.HasPrefix(keys[j], prefix) {
+		j++
+	}
+	return keys[i:j], nil
+}
+
+// isDir reports whether any key lies below name.
+func (kfs *keyFS) isDir(name string) (bool, error) {
+	if name == "." {
+		return true, nil
+	}
+	keys, err := kfs.below(name + "/")
+	return len(keys) > 0, err
+}
+
+func (kfs *keyFS) readDir(name string) ([]fs.DirEntry, error) {
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	keys, err := kfs.below(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := map[string]bool{}
+	files := map[string]bool{}
+	for _, key := range keys {
+		rest := key[len(prefix):]
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			dirs[rest[:i]] = true
+		} else {
+			files[rest] = true
+		}
+	}
+
+	entries := []fs.DirEntry{}
+	for child := range dirs {
+		entries = append(entries, fs.FileInfoToDirEntry(dirInfo(child)))
+	}
+	for child := range files {
+		if !dirs[child] {
+			entries = append(entries, &keyDirEntry{kfs: kfs, key: prefix + child})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+type keyFile struct {
+	*Handle
+	info *keyInfo
+}
+
+func (f *keyFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+type keyDir struct {
+	info    *keyInfo
+	entries []fs.DirEntry
+	pos     int
+}
+
+func (d *keyDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *keyDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *keyDir) Close() error {
+	return nil
+}
+
+func (d *keyDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.pos:]
+	if n <= 0 {
+		d.pos = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.pos += n
+	return rest[:n], nil
+}
+
+type keyDirEntry struct {
+	kfs *keyFS
+	key string
+}
+
+func (e *keyDirEntry) Name() string {
+	return baseName(e.key)
+}
+
+func (e *keyDirEntry) IsDir() bool {
+	return false
+}
+
+func (e *keyDirEntry) Type() fs.FileMode {
+	return 0
+}
+
+func (e *keyDirEntry) Info() (fs.FileInfo, error) {
+	return e.kfs.Stat(e.key)
+}
+
+type keyInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func fileInfo(h *Handle, key string) (*keyInfo, error) {
+	size, err := h.Size()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := h.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &keyInfo{name: baseName(key), size: size, mode: 0444, modTime: fi.ModTime()}, nil
+}
+
+func dirInfo(name string) *keyInfo {
+	return &keyInfo{name: baseName(name), mode: fs.ModeDir | 0555}
+}
+
+func (i *keyInfo) Name() string       { return i.name }
+func (i *keyInfo) Size() int64        { return i.size }
+func (i *keyInfo) Mode() fs.FileMode  { return i.mode }
+func (i *keyInfo) ModTime() time.Time { return i.modTime }
+func (i *keyInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *keyInfo) Sys() any           { return nil }
+
+func baseName(name string) string {
+	return name[strings.LastIndexByte(name, '/')+1:]
+}
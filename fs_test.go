@@ -0,0 +1,117 @@
+package studydiskv
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func slashTransform(s string) *PathKey {
+	path := strings.Split(s, "/")
+	last := len(path) - 1
+	return &PathKey{Path: path[:last], FileName: path[last]}
+}
+
+func slashInverseTransform(pathKey *PathKey) string {
+	return strings.Join(append(append([]string{}, pathKey.Path...), pathKey.FileName), "/")
+}
+
+func TestFS(t *testing.T) {
+	d := New(Options{
+		BasePath:          "test-fs",
+		AdvancedTransform: slashTransform,
+		InverseTransform:  slashInverseTransform,
+		Compression:       NewGzipCompression(),
+	})
+	defer d.EraseAll()
+
+	for key, val := range map[string]string{
+		"top":            "top value",
+		"a/one":          "one",
+		"a/two":          strings.Repeat("two ", 1000),
+		"a/b/three":      "three",
+		"templates/x.go": "{{.}}",
+	} {
+		if err := d.WriteString(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fsys := d.FS()
+	if err := fstest.TestFS(fsys, "top", "a/one", "a/two", "a/b/three", "templates/x.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := fs.ReadFile(fsys, "a/two")
+	if err != nil || string(b) != strings.Repeat("two ", 1000) {
+		t.Errorf("ReadFile: have %d bytes, %v", len(b), err)
+	}
+	entries, err := fs.ReadDir(fsys, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if !cmpStrings(names, []string{"b", "one", "two"}) || !entries[0].IsDir() {
+		t.Errorf("ReadDir: have %v", names)
+	}
+	if _, err := fs.Stat(fsys, "a/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat: want not-exist error, have %v", err)
+	}
+}
+
+// walkCountFS counts the walks made of it.
+type walkCountFS struct {
+	FS
+	walks int
+}
+
+func (f *walkCountFS) Walk(root string, fn filepath.WalkFunc) error {
+	f.walks++
+	return f.FS.Walk(root, fn)
+}
+
+func TestFSWalks(t *testing.T) {
+	fsys := &walkCountFS{FS: NewMemFS()}
+	d := New(Options{
+		BasePath:          "test-fs-walks",
+		FileSystem:        fsys,
+		AdvancedTransform: slashTransform,
+		InverseTransform:  slashInverseTransform,
+	})
+	for i := 0; i < 50; i++ {
+		d.WriteString(fmt.Sprintf("d%d/k%d", i%5, i), "v")
+	}
+
+	kfs := d.FS()
+	files := 0
+	err := fs.WalkDir(kfs, ".", func(path string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		files++
+		_, err = fs.ReadFile(kfs, path)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 50 || fsys.walks != 1 {
+		t.Errorf("want 50 files in 1 walk, have %d in %d", files, fsys.walks)
+	}
+
+	// A new key is seen, at the cost of another walk.
+	d.WriteString("d9/new", "v")
+	if _, err := fs.Stat(kfs, "d9/new"); err != nil {
+		t.Error(err)
+	}
+	if fsys.walks != 2 {
+		t.Errorf("want 2 walks, have %d", fsys.walks)
+	}
+}
@@ -1,5 +1,5 @@
 module studydiskv
 
-go 1.21
+go 1.23
 
-require github.com/google/btree v1.1.2 // indirect
+require github.com/google/btree v1.1.2
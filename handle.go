@@ -0,0 +1,261 @@
+package studydiskv
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	errNegativeOffset = errors.New("negative offset")
+	errWhence         = errors.New("invalid whence")
+)
+
+// Handle gives random access to a stored value, like an *os.File opened
+// read-only. Raw values and values in the seekable format are read in
+// place; other compressed values are decoded from the start whenever a
+// read goes backwards.
+type Handle struct {
+	f   File
+	v   valueReaderAt
+	pos int64
+}
+
+type valueReaderAt interface {
+	io.ReaderAt
+	Size() (int64, error)
+}
+
+// Open opens the value of key for reading. It bypasses the cache.
+func (d *Diskv) Open(key string) (*Handle, error) {
+	pathKey := d.transform(key)
+	d.mu.RLock()
+	legacy := d.compressionFor(key)
+	d.mu.RUnlock()
+
+	filename := d.completeFilename(pathKey)
+	fi, err := d.FileSystem.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := openFile(d.FileSystem, filename)
+	if err != nil {
+		return nil, err
+	}
+	v, err := d.newValueReaderAt(f, fi.Size(), legacy)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Handle{f: f, v: v}, nil
+}
+
+func (d *Diskv) newValueReaderAt(f File, size int64, legacy Compression) (valueReaderAt, error) {
+	hdr := make([]byte, len(codecMagic)+1)
+	n, err := f.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	c, skip, err := valueCodec(hdr[:n], legacy)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return &rawValue{ra: f, base: int64(skip), size: size - int64(skip)}, nil
+	}
+	if cc, ok := c.(Codec); ok && cc.CodecID() == seekableCodecID {
+		return newSeekableValue(f, int64(skip), size)
+	}
+	c = d.decoder(c)
+	return &streamValue{open: func() (io.ReadCloser, error) {
+		return c.Reader(io.NewSectionReader(f, int64(skip), size-int64(skip)))
+	}, size: -1}, nil
+}
+
+func (h *Handle) Read(p []byte) (int, error) {
+	n, err := h.v.ReadAt(p, h.pos)
+	h.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (h *Handle) ReadAt(p []byte, off int64) (int, error) {
+	return h.v.ReadAt(p, off)
+}
+
+func (h *Handle) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += h.pos
+	case io.SeekEnd:
+		size, err := h.v.Size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, errWhence
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	h.pos = offset
+	return offset, nil
+}
+
+// Size returns the length of the value, decoding it if that is the only
+// way to find out.
+func (h *Handle) Size() (int64, error) {
+	return h.v.Size()
+}
+
+func (h *Handle) Close() error {
+	if c, ok := h.v.(io.Closer); ok {
+		c.Close()
+	}
+	return h.f.Close()
+}
+
+// ReadRange returns a reader over length bytes of the value of key,
+// starting at off. A negative length reads to the end of the value.
+func (d *Diskv) ReadRange(key string, off, length int64) (io.ReadCloser, error) {
+	h, err := d.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		size, err := h.Size()
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+		length = size - off
+	}
+	return &rangeReader{SectionReader: io.NewSectionReader(h, off, length), h: h}, nil
+}
+
+type rangeReader struct {
+	*io.SectionReader
+	h *Handle
+}
+
+func (r *rangeReader) Close() error {
+	return r.h.Close()
+}
+
+type rawValue struct {
+	ra   io.ReaderAt
+	base int64
+	size int64
+}
+
+func (v *rawValue) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	if max := v.size - off; int64(len(p)) > max {
+		p = p[:max]
+		n, err := v.ra.ReadAt(p, v.base+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return v.ra.ReadAt(p, v.base+off)
+}
+
+func (v *rawValue) Size() (int64, error) {
+	return v.size, nil
+}
+
+// streamValue reads ranges of a value only decodable from its start. Its
+// decoder is shared, so ReadAt calls take turns.
+type streamValue struct {
+	open func() (io.ReadCloser, error)
+
+	mu   sync.Mutex
+	rc   io.ReadCloser
+	pos  int64
+	size int64
+}
+
+func (v *streamValue) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.rc == nil || off < v.pos {
+		if err := v.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	if skip := off - v.pos; skip > 0 {
+		n, err := io.CopyN(io.Discard, v.rc, skip)
+		v.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(v.rc, p)
+	v.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (v *streamValue) reopen() error {
+	if v.rc != nil {
+		v.rc.Close()
+	}
+	rc, err := v.open()
+	if err != nil {
+		return err
+	}
+	v.rc, v.pos = rc, 0
+	return nil
+}
+
+func (v *streamValue) Size() (int64, error) {
+	v.mu.Lock()
+	size := v.size
+	v.mu.Unlock()
+	if size >= 0 {
+		return size, nil
+	}
+	rc, err := v.open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	n, err := io.Copy(io.Discard, rc)
+	if err != nil {
+		return 0, err
+	}
+	v.mu.Lock()
+	v.size = n
+	v.mu.Unlock()
+	return n, nil
+}
+
+func (v *streamValue) Close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.rc == nil {
+		return nil
+	}
+	return v.rc.Close()
+}
@@ -0,0 +1,181 @@
+package studydiskv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadRange(t *testing.T) {
+	val := make([]byte, 1000)
+	for i := range val {
+		val[i] = byte('a' + i%26)
+	}
+
+	codecs := map[string]Compression{
+		"none":     nil,
+		"gzip":     NewGzipCompression(),
+		"seekable": NewSeekableCompression(100),
+		"magic":    nil,
+	}
+	for name, c := range codecs {
+		d := New(Options{
+			BasePath:    "test-range",
+			Compression: c,
+		})
+		v := val
+		if name == "magic" {
+			v = append([]byte(codecMagic+"\x00"), val...)
+		}
+		if err := d.Write("key", v); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, r := range [][2]int64{{0, 10}, {95, 10}, {250, 300}, {990, 10}, {990, 100}, {0, -1}, {500, -1}} {
+			rc, err := d.ReadRange("key", r[0], r[1])
+			if err != nil {
+				t.Fatalf("%s %v: %s", name, r, err)
+			}
+			have, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("%s %v: %s", name, r, err)
+			}
+			end := int64(len(v))
+			if r[1] >= 0 && r[0]+r[1] < end {
+				end = r[0] + r[1]
+			}
+			if want := v[r[0]:end]; !bytes.Equal(want, have) {
+				t.Errorf("%s %v: want %q, have %q", name, r, want, have)
+			}
+		}
+		d.EraseAll()
+	}
+}
+
+func TestHandleSeek(t *testing.T) {
+	for _, c := range []Compression{nil, NewSeekableCompression(7), NewSnappyCompression()} {
+		d := New(Options{
+			BasePath:    "test-range",
+			Compression: c,
+		})
+		val := []byte("0123456789abcdefghij")
+		d.Write("key", val)
+
+		h, err := d.Open("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size, err := h.Size(); err != nil || size != int64(len(val)) {
+			t.Errorf("%v: want size %d, have %d (err = %v)", c, len(val), size, err)
+		}
+		if pos, _ := h.Seek(-5, io.SeekEnd); pos != 15 {
+			t.Errorf("%v: want position 15, have %d", c, pos)
+		}
+		rest, _ := ioutil.ReadAll(h)
+		if string(rest) != "fghij" {
+			t.Errorf("%v: want %q, have %q", c, "fghij", rest)
+		}
+
+		p := make([]byte, 4)
+		if n, err := h.ReadAt(p, 3); err != nil || string(p[:n]) != "3456" {
+			t.Errorf("%v: want %q, have %q (err = %v)", c, "3456", p[:n], err)
+		}
+		if _, err := h.ReadAt(p, 100); err != io.EOF {
+			t.Errorf("%v: want EOF past the end, have %v", c, err)
+		}
+		h.Close()
+		d.EraseAll()
+	}
+}
+
+func TestHandleReadAtParallel(t *testing.T) {
+	val := make([]byte, 10000)
+	for i := range val {
+		val[i] = byte('a' + i%26)
+	}
+
+	for _, c := range []Compression{nil, NewGzipCompression(), NewSeekableCompression(100)} {
+		d := New(Options{
+			BasePath:    "test-range",
+			Compression: c,
+		})
+		d.Write("key", val)
+		h, err := d.Open("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				p := make([]byte, 37)
+				for i := 0; i < 50; i++ {
+					off := int64((g*1237 + i*811) % (len(val) - len(p)))
+					n, err := h.ReadAt(p, off)
+					if err != nil || !bytes.Equal(p[:n], val[off:off+int64(len(p))]) {
+						t.Errorf("%v: at %d: have %q (err = %v)", c, off, p[:n], err)
+						return
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		h.Close()
+		d.EraseAll()
+	}
+}
+
+func TestSeekable(t *testing.T) {
+	testCompressionWith(t, NewSeekableCompression(0), "seekable")
+
+	d := New(Options{
+		BasePath:    "test-range",
+		Compression: NewSeekableCompression(16),
+	})
+	defer d.EraseAll()
+	for _, size := range []int{0, 1, 16, 17, 1000} {
+		val := bytes.Repeat([]byte("x"), size)
+		key := fmt.Sprint(size)
+		d.Write(key, val)
+		if have, err := d.Read(key); err != nil || !bytes.Equal(have, val) {
+			t.Errorf("size %d: read back %d bytes (err = %v)", size, len(have), err)
+		}
+	}
+}
+
+func TestStat(t *testing.T) {
+	d := New(Options{
+		BasePath:    "test-stat",
+		Compression: NewSnappyCompression(),
+	})
+	defer d.EraseAll()
+
+	val := strings.Repeat("stat me ", 100)
+	if err := d.WriteString("k", val); err != nil {
+		t.Fatal(err)
+	}
+	info, err := d.Stat("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Codec != "snappy" || info.Size != int64(len(val)) || info.StoredSize >= info.Size {
+		t.Errorf("have %+v", info)
+	}
+
+	d.CompressionFor = func(string) Compression { return nil }
+	d.WriteString("raw", "x")
+	if info, err := d.Stat("raw"); err != nil || info.Codec != "raw" || info.Size != 1 {
+		t.Errorf("have %+v, %v", info, err)
+	}
+	if _, err := d.Stat("missing"); !os.IsNotExist(err) {
+		t.Errorf("want not-exist error, have %v", err)
+	}
+}
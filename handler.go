@@ -0,0 +1,250 @@
+package studydiskv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+var errPrecondition = errors.New("precondition failed")
+
+// KeyList is a page of keys as served by the Handler. Next, when not
+// empty, is the after parameter that fetches the following page.
+type KeyList struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next,omitempty"`
+}
+
+type handler struct {
+	d *Diskv
+}
+
+// NewHandler serves d over HTTP:
+//
+//	GET    /keys/{key}   the value, with Range and conditional requests
+//	HEAD   /keys/{key}   as GET, without the value
+//	PUT    /keys/{key}   stores the request body, syncing it if sync=1
+//	DELETE /keys/{key}   erases the key
+//	GET    /keys?prefix=&after=&limit=   a KeyList, as JSON
+//
+// Values carry an ETag, which PUT and DELETE honor in If-Match, and PUT in
+// If-None-Match.
+func NewHandler(d *Diskv) http.Handler {
+	h := &handler{d: d}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /keys", h.list)
+	mux.HandleFunc("GET /keys/{key...}", h.get)
+	mux.HandleFunc("PUT /keys/{key...}", h.put)
+	mux.HandleFunc("DELETE /keys/{key...}", h.delete)
+	return mux
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		h.list(w, r)
+		return
+	}
+	v, err := h.d.Open(key)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer v.Close()
+	fi, err := v.f.Stat()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(fi))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", fi.ModTime(), v)
+}
+
+func (h *handler) put(w http.ResponseWriter, r *http.Request) {
+	var created bool
+	sync := r.URL.Query().Get("sync") == "1"
+	fi, err := h.d.writeStreamIf(r.PathValue("key"), r.Body, sync, func(fi os.FileInfo) bool {
+		created = fi == nil
+		return checkPreconditions(r, fi)
+	})
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag(fi))
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *handler) delete(w http.ResponseWriter, r *http.Request) {
+	err := h.d.eraseIf(r.PathValue("key"), func(fi os.FileInfo) bool {
+		return checkPreconditions(r, fi)
+	})
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := defaultListLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxListLimit)
+	}
+
+	list := KeyList{Keys: []string{}}
+	for key, err := range h.d.keysAfter(q.Get("prefix"), q.Get("after")) {
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if len(list.Keys) == limit {
+			list.Next = list.Keys[limit-1]
+			break
+		}
+		list.Keys = append(list.Keys, key)
+	}
+
+	buf, err := json.Marshal(list)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(buf, '\n'))
+}
+
+// checkPreconditions evaluates If-Match and If-None-Match against the
+// current file of a key, nil if there is none.
+func checkPreconditions(r *http.Request, fi os.FileInfo) bool {
+	if im := r.Header.Get("If-Match"); im != "" {
+		if fi == nil || !matchETag(im, etag(fi)) {
+			return false
+		}
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if fi != nil && matchETag(inm, etag(fi)) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchETag(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		if t = strings.TrimSpace(t); t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// etag identifies the stored file of a value. Writes replace the file, so
+// its size and modification time change with every write.
+func etag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "not found", http.StatusNotFound)
+	case err == errPrecondition:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case err == ErrReadOnly:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case err == errEmpty, err == errBadKey:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeStreamIf is WriteStream, done only if cond approves of the key's
+// current file, or its absence. It returns the file written.
+func (d *Diskv) writeStreamIf(key string, r io.Reader, sync bool, cond func(fi os.FileInfo) bool) (os.FileInfo, error) {
+	if d.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if key == "" {
+		return nil, errEmpty
+	}
+	pathKey := d.transform(key)
+	if err := d.validateKey(pathKey); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	filename := d.completeFilename(pathKey)
+	fi, err := d.statFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !cond(fi) {
+		return nil, errPrecondition
+	}
+	if err := d.writeStreamWithLock(pathKey, r, d.compressionFor(key), sync); err != nil {
+		return nil, err
+	}
+	return d.FileSystem.Stat(filename)
+}
+
+// eraseIf is Erase, done only if cond approves of the key's current file.
+func (d *Diskv) eraseIf(key string, cond func(fi os.FileInfo) bool) error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fi, err := d.statFile(d.completeFilename(d.transform(key)))
+	if err != nil {
+		return err
+	}
+	if fi == nil {
+		return os.ErrNotExist
+	}
+	if !cond(fi) {
+		return errPrecondition
+	}
+	return d.eraseWithLock(key)
+}
+
+// statFile stats the file of a value, returning nil if it does not exist.
+func (d *Diskv) statFile(filename string) (os.FileInfo, error) {
+	fi, err := d.FileSystem.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, errBadKey
+	}
+	return fi, nil
+}
@@ -0,0 +1,158 @@
+package studydiskv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	d := New(Options{
+		BasePath:    "test-handler",
+		Compression: NewGzipCompression(),
+	})
+	defer d.EraseAll()
+	srv := httptest.NewServer(NewHandler(d))
+	defer srv.Close()
+
+	do := func(method, path, body string, hdr ...string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expect := func(resp *http.Response, status int, body string) {
+		t.Helper()
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != status {
+			t.Errorf("%s %s: want status %d, have %d (%s)", resp.Request.Method, resp.Request.URL.Path, status, resp.StatusCode, b)
+		}
+		if body != "" && string(b) != body {
+			t.Errorf("%s %s: want body %q, have %q", resp.Request.Method, resp.Request.URL.Path, body, b)
+		}
+	}
+
+	resp := do("PUT", "/keys/greeting", "hello, world")
+	expect(resp, http.StatusCreated, "")
+	tag := resp.Header.Get("ETag")
+	if d.ReadString("greeting") != "hello, world" {
+		t.Fatalf("value not stored")
+	}
+
+	resp = do("GET", "/keys/greeting", "")
+	if have := resp.Header.Get("ETag"); have != tag {
+		t.Errorf("ETag: want %s, have %s", tag, have)
+	}
+	expect(resp, http.StatusOK, "hello, world")
+	expect(do("GET", "/keys/greeting", "", "Range", "bytes=7-11"), http.StatusPartialContent, "world")
+	expect(do("GET", "/keys/greeting", "", "If-None-Match", tag), http.StatusNotModified, "")
+	resp = do("HEAD", "/keys/greeting", "")
+	if resp.ContentLength != 12 {
+		t.Errorf("HEAD: want length 12, have %d", resp.ContentLength)
+	}
+	expect(resp, http.StatusOK, "")
+
+	expect(do("PUT", "/keys/greeting", "x", "If-None-Match", "*"), http.StatusPreconditionFailed, "")
+	expect(do("PUT", "/keys/greeting", "x", "If-Match", `"stale"`), http.StatusPreconditionFailed, "")
+	expect(do("PUT", "/keys/greeting", "hi", "If-Match", tag), http.StatusNoContent, "")
+	expect(do("DELETE", "/keys/greeting", "", "If-Match", tag), http.StatusPreconditionFailed, "")
+	expect(do("DELETE", "/keys/greeting", ""), http.StatusNoContent, "")
+	expect(do("GET", "/keys/greeting", ""), http.StatusNotFound, "")
+	expect(do("DELETE", "/keys/greeting", ""), http.StatusNotFound, "")
+	expect(do("PUT", "/keys/a%2Fb", "x"), http.StatusBadRequest, "")
+	expect(do("POST", "/keys/greeting", "x"), http.StatusMethodNotAllowed, "")
+}
+
+func TestHandlerList(t *testing.T) {
+	d := New(Options{
+		BasePath:  "test-handler-list",
+		Index:     &BTreeIndex{},
+		IndexLess: strLess,
+	})
+	defer d.EraseAll()
+	for i := 0; i < 25; i++ {
+		d.WriteString(fmt.Sprintf("a%02d", i), "v")
+	}
+	d.WriteString("b", "v")
+	h := NewHandler(d)
+
+	keys, after := []string{}, ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		req := httptest.NewRequest("GET", "/keys?prefix=a&limit=10&after="+after, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var list KeyList
+		if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, list.Keys...)
+		if list.Next == "" {
+			break
+		}
+		after = list.Next
+	}
+	if len(keys) != 25 || keys[0] != "a00" || keys[24] != "a24" {
+		t.Errorf("have %v", keys)
+	}
+}
+
+func TestHandlerListIndexOrder(t *testing.T) {
+	d := New(Options{
+		BasePath:  "test-handler-list-order",
+		Index:     &BTreeIndex{},
+		IndexLess: func(a, b string) bool { return a > b },
+	})
+	defer d.EraseAll()
+	for i := 0; i < 6; i++ {
+		d.WriteString(fmt.Sprintf("k%d", i), "v")
+	}
+	h := NewHandler(d)
+
+	// Pages are taken alternately while the Index is building and once it
+	// is ready; both follow IndexLess.
+	keys, after := []string{}, ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		d.mu.Lock()
+		if pages%2 == 0 {
+			d.indexState = IndexBuilding
+		} else {
+			d.indexState = IndexReady
+		}
+		d.mu.Unlock()
+
+		req := httptest.NewRequest("GET", "/keys?limit=2&after="+after, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var list KeyList
+		if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, list.Keys...)
+		if list.Next == "" {
+			break
+		}
+		after = list.Next
+	}
+	if want := []string{"k5", "k4", "k3", "k2", "k1", "k0"}; !cmpStrings(keys, want) {
+		t.Errorf("want %v, have %v", want, keys)
+	}
+}
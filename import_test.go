@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"studydiskv"
 	"testing"
 )
@@ -34,7 +37,7 @@ func TestImportMove(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := os.Stat(f.Name()); err == nil || os.IsNotExist(err) {
+	if _, err := os.Stat(f.Name()); err == nil || !os.IsNotExist(err) {
 		t.Errorf("expected temp to be gone, but err = %v", err)
 	}
 
@@ -72,3 +75,146 @@ func TestImportCopy(t *testing.T) {
 		t.Errorf("expected temp file to remain, but got err = %v", err)
 	}
 }
+
+func tempFileWith(t *testing.T, b []byte) string {
+	f, err := ioutil.TempFile("", "temp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return f.Name()
+}
+
+func TestImportMoveIndexed(t *testing.T) {
+	d := studydiskv.New(studydiskv.Options{
+		BasePath:  "test-import-index",
+		Index:     &studydiskv.BTreeIndex{},
+		IndexLess: func(a, b string) bool { return a < b },
+	})
+	defer d.EraseAll()
+
+	if err := d.Import(tempFileWith(t, []byte("x")), "key", true); err != nil {
+		t.Fatal(err)
+	}
+	if keys := d.Index.Keys("", 10); len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("want [key] indexed, have %v", keys)
+	}
+}
+
+func TestImportBadKey(t *testing.T) {
+	d := studydiskv.New(studydiskv.Options{
+		BasePath: "test-import-bad-key",
+	})
+	defer d.EraseAll()
+
+	name := tempFileWith(t, []byte("x"))
+	defer os.Remove(name)
+	if err := d.Import(name, "a/b", true); err == nil {
+		t.Errorf("expected bad key error")
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("expected source to remain, but got err = %v", err)
+	}
+}
+
+func TestImportMoveCompressed(t *testing.T) {
+	b := []byte(`0123456789`)
+	d := studydiskv.New(studydiskv.Options{
+		BasePath:    "test-import-compressed",
+		Compression: studydiskv.NewGzipCompression(),
+	})
+	defer d.EraseAll()
+
+	name := tempFileWith(t, b)
+	if err := d.Import(name, "key", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected temp to be gone, but err = %v", err)
+	}
+	if buf, err := d.Read("key"); err != nil || bytes.Compare(b, buf) != 0 {
+		t.Errorf("want %q, have %q (err = %v)", string(b), string(buf), err)
+	}
+}
+
+func TestImportDir(t *testing.T) {
+	src, err := ioutil.TempDir("", "temp-test-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	files := map[string]string{"a": "1", "sub/b": "2", "sub/deeper/c": "3", "skip": "4"}
+	for name, val := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0777)
+		if err := ioutil.WriteFile(path, []byte(val), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := studydiskv.New(studydiskv.Options{
+		BasePath: "test-import-dir",
+	})
+	defer d.EraseAll()
+
+	keyFunc := func(relPath string) string {
+		if relPath == "skip" {
+			return ""
+		}
+		return strings.Replace(relPath, "/", "-", -1)
+	}
+	if err := d.ImportDir(src, keyFunc, false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": "1", "sub-b": "2", "sub-deeper-c": "3"}
+	have := map[string]string{}
+	for key := range d.Keys(nil) {
+		have[key] = d.ReadString(key)
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestImportIntoMemFS(t *testing.T) {
+	src := t.TempDir()
+	for name, val := range map[string]string{"a": "1", "sub/b": "2"} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0777)
+		if err := ioutil.WriteFile(path, []byte(val), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := studydiskv.New(studydiskv.Options{
+		BasePath:   "test-import-memfs",
+		FileSystem: studydiskv.NewMemFS(),
+	})
+	keyFunc := func(relPath string) string {
+		return strings.Replace(relPath, "/", "-", -1)
+	}
+	if err := d.ImportDir(src, keyFunc, false); err != nil {
+		t.Fatal(err)
+	}
+	moved := filepath.Join(src, "a")
+	if err := d.Import(moved, "moved", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(moved); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be gone, but err = %v", moved, err)
+	}
+
+	want := map[string]string{"a": "1", "sub-b": "2", "moved": "1"}
+	have := map[string]string{}
+	for key := range d.Keys(nil) {
+		have[key] = d.ReadString(key)
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
@@ -1,6 +1,7 @@
 package studydiskv
 
 import (
+	"context"
 	"sync"
 
 	"github.com/google/btree"
@@ -15,6 +16,99 @@ type Index interface {
 
 type LessFunction func(string, string) bool
 
+type IndexState int
+
+const (
+	IndexNone IndexState = iota
+	IndexBuilding
+	IndexReady
+	IndexFailed
+)
+
+type indexOp struct {
+	key    string
+	insert bool
+}
+
+func (d *Diskv) buildIndex() {
+	var walkErr error
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+		for key, err := range d.walkKeys("") {
+			if err != nil {
+				walkErr = err
+				return
+			}
+			keys <- key
+		}
+	}()
+	d.Index.Initialize(d.IndexLess, keys)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, op := range d.indexPending {
+		d.applyIndexOp(op)
+	}
+	d.indexPending = nil
+	d.indexErr = walkErr
+	d.indexState = IndexReady
+	if walkErr != nil {
+		d.indexState = IndexFailed
+	}
+	close(d.indexDone)
+}
+
+// IndexState reports whether the Index has finished its initial build.
+// Until it has, key enumeration walks BasePath and index updates are
+// buffered.
+func (d *Diskv) IndexState() IndexState {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.indexState
+}
+
+// WaitIndexReady blocks until the initial Index build finishes, returning
+// the error that ended it, if any.
+func (d *Diskv) WaitIndexReady(ctx context.Context) error {
+	if d.indexDone == nil {
+		return nil
+	}
+	select {
+	case <-d.indexDone:
+		return d.indexErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Diskv) indexInsertWithLock(key string) {
+	d.indexOpWithLock(indexOp{key: key, insert: true})
+}
+
+func (d *Diskv) indexDeleteWithLock(key string) {
+	d.indexOpWithLock(indexOp{key: key, insert: false})
+}
+
+func (d *Diskv) indexOpWithLock(op indexOp) {
+	d.keysGen++
+	switch d.indexState {
+	case IndexNone:
+	case IndexBuilding:
+		d.indexPending = append(d.indexPending, op)
+	default:
+		d.applyIndexOp(op)
+	}
+}
+
+func (d *Diskv) applyIndexOp(op indexOp) {
+	if op.insert {
+		d.Index.Insert(op.key)
+	} else {
+		d.Index.Delete(op.key)
+	}
+}
+
 type btreeString struct {
 	s string
 	l LessFunction
@@ -70,26 +164,24 @@ func (i *BTreeIndex) Keys(from string, n int) []string {
 	}
 
 	btreeFrom := btreeString{s: from, l: i.LessFunction}
-	skipFirst := true
-	if len(from) <= 0 || i.BTree.Has(btreeFrom) {
+	if len(from) <= 0 {
 		btreeFrom = btreeString{s: "", l: func(string, string) bool {
 			return true
 		}}
-		skipFirst = false
 	}
 
 	keys := []string{}
 	iterator := func(i btree.Item) bool {
-		keys = append(keys, i.(btreeString).s)
+		s := i.(btreeString).s
+		if s == from {
+			return true
+		}
+		keys = append(keys, s)
 		return len(keys) < n
 	}
 
 	i.BTree.AscendGreaterOrEqual(btreeFrom, iterator)
 
-	if skipFirst && len(keys) > 0 {
-		keys = keys[1:]
-	}
-
 	return keys
 }
 
@@ -2,8 +2,10 @@ package studydiskv
 
 import (
 	"bytes"
+	"context"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func strLess(a, b string) bool { return a < b }
@@ -46,7 +48,7 @@ func TestIndexOrder(t *testing.T) {
 
 	v := []byte{'1', '2', '3'}
 	d.Write("a", v)
-	if d.isIndexed("a") {
+	if !d.isIndexed("a") {
 		t.Fatalf("'a' not indexed after write")
 	}
 	d.Write("1", v)
@@ -137,3 +139,68 @@ func TestBadKeys(t *testing.T) {
 		}
 	}
 }
+
+type gatedIndex struct {
+	BTreeIndex
+	gate chan struct{}
+}
+
+func (i *gatedIndex) Initialize(less LessFunction, keys <-chan string) {
+	<-i.gate
+	i.BTreeIndex.Initialize(less, keys)
+}
+
+func TestIndexAsync(t *testing.T) {
+	d1 := New(Options{
+		BasePath: "index-test",
+	})
+	defer d1.EraseAll()
+	for _, k := range []string{"a", "b", "c"} {
+		d1.Write(k, []byte("1"))
+	}
+
+	idx := &gatedIndex{gate: make(chan struct{})}
+	d2 := New(Options{
+		BasePath:   "index-test",
+		Index:      idx,
+		IndexLess:  strLess,
+		IndexAsync: true,
+	})
+
+	if state := d2.IndexState(); state != IndexBuilding {
+		t.Fatalf("want IndexBuilding, have %v", state)
+	}
+
+	if err := d2.Write("d", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d2.Erase("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"b", "c", "d"}
+	keys := []string{}
+	for key := range d2.Keys(nil) {
+		keys = append(keys, key)
+	}
+	if !reflect.DeepEqual(want, keys) {
+		t.Errorf("while building: want %v, have %v", want, keys)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	if err := d2.WaitIndexReady(ctx); err != context.DeadlineExceeded {
+		t.Errorf("want deadline exceeded, have %v", err)
+	}
+	cancel()
+
+	close(idx.gate)
+	if err := d2.WaitIndexReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if state := d2.IndexState(); state != IndexReady {
+		t.Fatalf("want IndexReady, have %v", state)
+	}
+	if have := d2.Index.Keys("", 100); !reflect.DeepEqual(want, have) {
+		t.Errorf("after build: want %v, have %v", want, have)
+	}
+}
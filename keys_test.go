@@ -0,0 +1,144 @@
+package studydiskv
+
+import (
+	"crypto/md5"
+	"fmt"
+	"iter"
+	"reflect"
+	"testing"
+)
+
+func hashTransform(s string) *PathKey {
+	sum := fmt.Sprintf("%x", md5.Sum([]byte(s)))
+	return &PathKey{Path: []string{sum[0:2], sum[2:4]}, FileName: s}
+}
+
+func hashInverseTransform(pathKey *PathKey) string {
+	return pathKey.FileName
+}
+
+func collectKeys(t *testing.T, d interface {
+	KeysSeq(string) iter.Seq2[string, error]
+}, prefix string) []string {
+	keys := []string{}
+	for key, err := range d.KeysSeq(prefix) {
+		if err != nil {
+			t.Fatalf("keys: %s", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestKeysSorted(t *testing.T) {
+	d := New(Options{
+		BasePath:          "test-keys",
+		AdvancedTransform: hashTransform,
+		InverseTransform:  hashInverseTransform,
+	})
+	defer d.EraseAll()
+
+	for _, k := range []string{"m", "b", "zz", "a", "ab"} {
+		if err := d.Write(k, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"a", "ab", "b", "m", "zz"}
+	if have := collectKeys(t, d, ""); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	have := []string{}
+	for key := range d.Keys(nil) {
+		have = append(have, key)
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("channel: want %v, have %v", want, have)
+	}
+}
+
+func TestKeysPrefixHashTransform(t *testing.T) {
+	d := New(Options{
+		BasePath:          "test-keys",
+		AdvancedTransform: hashTransform,
+		InverseTransform:  hashInverseTransform,
+	})
+	defer d.EraseAll()
+
+	for _, k := range []string{"user-1", "user-2", "group-1", "user-10"} {
+		if err := d.Write(k, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"user-1", "user-10", "user-2"}
+	have := []string{}
+	for key := range d.KeysPrefix("user-", nil) {
+		have = append(have, key)
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestKeysEmptyStore(t *testing.T) {
+	d := New(Options{
+		BasePath: "test-keys-missing",
+	})
+	if have := collectKeys(t, d, ""); len(have) != 0 {
+		t.Errorf("want no keys, have %v", have)
+	}
+}
+
+func TestKeysFromIndex(t *testing.T) {
+	d := New(Options{
+		BasePath:  "test-keys",
+		Index:     &BTreeIndex{},
+		IndexLess: strLess,
+	})
+	defer d.EraseAll()
+
+	want := []string{}
+	for i := 0; i < indexPageSize+10; i++ {
+		k := fmt.Sprintf("k%05d", i)
+		if err := d.Write(k, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, k)
+	}
+	if err := d.Write("other", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if have := collectKeys(t, d, "k"); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %d keys, have %d", len(want), len(have))
+	}
+
+	if have := collectKeys(t, d, "k0100"); len(have) != 10 {
+		t.Errorf("want 10 keys, have %v", have)
+	}
+}
+
+func TestIndexKeysFrom(t *testing.T) {
+	d := New(Options{
+		BasePath:  "test-keys",
+		Index:     &BTreeIndex{},
+		IndexLess: strLess,
+	})
+	defer d.EraseAll()
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		d.Write(k, []byte("1"))
+	}
+
+	if want, have := []string{"c", "d"}, d.Index.Keys("b", 10); !reflect.DeepEqual(want, have) {
+		t.Errorf("from existing key: want %v, have %v", want, have)
+	}
+	if want, have := []string{"c", "d"}, d.Index.Keys("bb", 10); !reflect.DeepEqual(want, have) {
+		t.Errorf("from missing key: want %v, have %v", want, have)
+	}
+	if want, have := []string{"b"}, d.Index.Keys("a", 1); !reflect.DeepEqual(want, have) {
+		t.Errorf("limited: want %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package studydiskv
+
+import (
+	"os"
+	"syscall"
+)
+
+func sysLinkCount(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
@@ -0,0 +1,536 @@
+package studydiskv
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNotDir      = errors.New("not a directory")
+	errIsDir       = errors.New("is a directory")
+	errDirNotEmpty = errors.New("directory not empty")
+	errBadFD       = errors.New("bad file descriptor")
+)
+
+// NewMemFS returns an FS held in memory, which starts out empty. Hard
+// links share their node, as on disk.
+func NewMemFS() FS {
+	return &memFS{nodes: map[string]*memNode{}}
+}
+
+type memFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+	seq   uint64
+}
+
+type memNode struct {
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+	nlink   int
+}
+
+var memRoot = &memNode{dir: true, mode: os.ModeDir | 0755}
+
+func isRoot(p string) bool {
+	return filepath.Dir(p) == p
+}
+
+func (m *memFS) lookupWithLock(p string) (*memNode, bool) {
+	if isRoot(p) {
+		return memRoot, true
+	}
+	n, ok := m.nodes[p]
+	return n, ok
+}
+
+// parentWithLock checks that the directory p would be created in exists.
+func (m *memFS) parentWithLock(p string) error {
+	parent, ok := m.lookupWithLock(filepath.Dir(p))
+	if !ok {
+		return os.ErrNotExist
+	}
+	if !parent.dir {
+		return errNotDir
+	}
+	return nil
+}
+
+func (m *memFS) childrenWithLock(p string) []string {
+	names := []string{}
+	for name := range m.nodes {
+		if name != p && filepath.Dir(name) == p {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.openFileWithLock(name, flag, perm)
+}
+
+func (m *memFS) openFileWithLock(name string, flag int, perm os.FileMode) (File, error) {
+	p := filepath.Clean(name)
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	n, ok := m.lookupWithLock(p)
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case ok && n.dir && writable:
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	case ok:
+		if flag&os.O_TRUNC != 0 && writable {
+			n.data, n.modTime = nil, time.Now()
+		}
+	case flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	default:
+		if err := m.parentWithLock(p); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		n = &memNode{mode: perm.Perm(), modTime: time.Now(), nlink: 1}
+		m.nodes[p] = n
+	}
+	return &memFile{m: m, name: name, n: n, flag: flag}, nil
+}
+
+func (m *memFS) TempFile(dir, pattern string) (File, error) {
+	if dir == "" {
+		dir = os.TempDir()
+		m.MkdirAll(dir, defaultPathPerm)
+	}
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		m.seq++
+		name := filepath.Join(dir, prefix+strconv.FormatUint(m.seq, 10)+suffix)
+		f, err := m.openFileWithLock(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	oldp, newp := filepath.Clean(oldpath), filepath.Clean(newpath)
+	n, ok := m.lookupWithLock(oldp)
+	if !ok || isRoot(oldp) {
+		return linkErr(os.ErrNotExist)
+	}
+	if oldp == newp {
+		return nil
+	}
+	if err := m.parentWithLock(newp); err != nil {
+		return linkErr(err)
+	}
+	if n.dir && strings.HasPrefix(newp, oldp+string(filepath.Separator)) {
+		return linkErr(os.ErrInvalid)
+	}
+
+	if dst, ok := m.lookupWithLock(newp); ok {
+		switch {
+		case dst.dir && !n.dir:
+			return linkErr(errIsDir)
+		case !dst.dir && n.dir:
+			return linkErr(errNotDir)
+		case dst.dir && len(m.childrenWithLock(newp)) > 0:
+			return linkErr(errDirNotEmpty)
+		}
+		dst.nlink--
+	}
+
+	delete(m.nodes, oldp)
+	m.nodes[newp] = n
+	if n.dir {
+		prefix := oldp + string(filepath.Separator)
+		for p, child := range m.nodes {
+			if strings.HasPrefix(p, prefix) {
+				delete(m.nodes, p)
+				m.nodes[filepath.Join(newp, p[len(prefix):])] = child
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memFS) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	oldp, newp := filepath.Clean(oldname), filepath.Clean(newname)
+	n, ok := m.lookupWithLock(oldp)
+	if !ok {
+		return linkErr(os.ErrNotExist)
+	}
+	if n.dir {
+		return linkErr(errIsDir)
+	}
+	if _, ok := m.lookupWithLock(newp); ok {
+		return linkErr(os.ErrExist)
+	}
+	if err := m.parentWithLock(newp); err != nil {
+		return linkErr(err)
+	}
+	m.nodes[newp] = n
+	n.nlink++
+	return nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := filepath.Clean(path)
+	dirs := []string{}
+	for ; !isRoot(p); p = filepath.Dir(p) {
+		if n, ok := m.nodes[p]; ok {
+			if !n.dir {
+				return &os.PathError{Op: "mkdir", Path: p, Err: errNotDir}
+			}
+			break
+		}
+		dirs = append(dirs, p)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		m.nodes[dirs[i]] = &memNode{dir: true, mode: os.ModeDir | perm.Perm(), modTime: time.Now(), nlink: 1}
+	}
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := filepath.Clean(name)
+	n, ok := m.nodes[p]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if n.dir && len(m.childrenWithLock(p)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+	}
+	delete(m.nodes, p)
+	n.nlink--
+	return nil
+}
+
+func (m *memFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := filepath.Clean(path)
+	prefix := p + string(filepath.Separator)
+	if isRoot(p) {
+		prefix = p
+	}
+	for name, n := range m.nodes {
+		if name == p || strings.HasPrefix(name, prefix) {
+			delete(m.nodes, name)
+			n.nlink--
+		}
+	}
+	return nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := filepath.Clean(name)
+	n, ok := m.lookupWithLock(p)
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return n.infoWithLock(filepath.Base(p)), nil
+}
+
+func (m *memFS) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, ok := m.nodes[filepath.Clean(name)]
+	if !ok {
+		return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
+	}
+	n.mode = n.mode&os.ModeDir | mode.Perm()
+	return nil
+}
+
+func (m *memFS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, ok := m.nodes[filepath.Clean(name)]
+	if !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	n.modTime = mtime
+	return nil
+}
+
+func (m *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := filepath.Clean(name)
+	n, ok := m.lookupWithLock(p)
+	if !ok {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	if !n.dir {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	entries := []os.DirEntry{}
+	for _, child := range m.childrenWithLock(p) {
+		info := m.nodes[filepath.Join(p, child)].infoWithLock(child)
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+// Walk visits files as filepath.Walk does, in lexical order. fn is called
+// without the file system locked, so it may change it.
+func (m *memFS) Walk(root string, fn filepath.WalkFunc) error {
+	info, err := m.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = m.walk(root, info, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func (m *memFS) walk(path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	m.mu.Lock()
+	names := m.childrenWithLock(filepath.Clean(path))
+	m.mu.Unlock()
+
+	if err := fn(path, info, nil); err != nil {
+		return err
+	}
+	for _, name := range names {
+		filename := filepath.Join(path, name)
+		fileInfo, err := m.Stat(filename)
+		if err != nil {
+			if err := fn(filename, fileInfo, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := m.walk(filename, fileInfo, fn); err != nil {
+			if !fileInfo.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (n *memNode) infoWithLock(name string) *memInfo {
+	return &memInfo{
+		name:    name,
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+		nlink:   n.nlink,
+	}
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	nlink   int
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) Mode() os.FileMode  { return i.mode }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memInfo) Sys() any           { return nil }
+
+type memFile struct {
+	m      *memFS
+	name   string
+	n      *memNode
+	flag   int
+	pos    int64
+	closed bool
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) check(write bool) error {
+	switch {
+	case f.closed:
+		return &os.PathError{Op: "use", Path: f.name, Err: os.ErrClosed}
+	case f.n.dir && write:
+		return &os.PathError{Op: "write", Path: f.name, Err: errIsDir}
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0, !write && f.flag&os.O_WRONLY != 0:
+		return &os.PathError{Op: "use", Path: f.name, Err: errBadFD}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	n, err := f.readAtWithLock(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	return f.readAtWithLock(p, off)
+}
+
+func (f *memFile) readAtWithLock(p []byte, off int64) (int, error) {
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	if f.n.dir {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errIsDir}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errNegativeOffset}
+	}
+	if off >= int64(len(f.n.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.n.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check(true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.n.data))
+	}
+	if end := f.pos + int64(len(p)); end > int64(len(f.n.data)) {
+		f.n.data = append(f.n.data, make([]byte, end-int64(len(f.n.data)))...)
+	}
+	copy(f.n.data[f.pos:], p)
+	f.pos += int64(len(p))
+	f.n.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.n.data))
+	default:
+		return 0, errWhence
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	return f.n.infoWithLock(filepath.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check(true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrInvalid}
+	}
+	if size <= int64(len(f.n.data)) {
+		f.n.data = f.n.data[:size]
+	} else {
+		f.n.data = append(f.n.data, make([]byte, size-int64(len(f.n.data)))...)
+	}
+	f.n.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
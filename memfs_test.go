@@ -0,0 +1,154 @@
+package studydiskv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	m := NewMemFS()
+	if err := m.MkdirAll("a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := m.OpenFile("a/b/f", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Errorf("write after close succeeded")
+	}
+
+	if _, err := m.OpenFile("missing/f", os.O_WRONLY|os.O_CREATE, 0644); !os.IsNotExist(err) {
+		t.Errorf("create without parent: have %v", err)
+	}
+	if err := m.Remove("a"); err == nil {
+		t.Errorf("removed a non-empty directory")
+	}
+
+	if err := m.Link("a/b/f", "a/g"); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := m.Stat("a/g")
+	if linkCount(fi) != 2 {
+		t.Errorf("link count: want 2, have %d", linkCount(fi))
+	}
+	a, _ := m.OpenFile("a/g", os.O_WRONLY|os.O_APPEND, 0)
+	a.Write([]byte(", world"))
+	a.Close()
+	if b, _ := readFile(m, "a/b/f"); string(b) != "hello, world" {
+		t.Errorf("linked file: have %q", b)
+	}
+
+	tmp, err := m.TempFile("a", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.Write([]byte("new"))
+	tmp.Close()
+	if err := m.Rename(tmp.Name(), "a/g"); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ = m.Stat("a/b/f")
+	if linkCount(fi) != 1 {
+		t.Errorf("link count after replace: want 1, have %d", linkCount(fi))
+	}
+	if b, _ := readFile(m, "a/g"); string(b) != "new" {
+		t.Errorf("renamed file: have %q", b)
+	}
+
+	if err := m.Rename("a/b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	visited := []string{}
+	m.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		visited = append(visited, filepath.ToSlash(path))
+		return nil
+	})
+	if want := []string{".", "a", "a/g", "c", "c/f"}; !cmpStrings(visited, want) {
+		t.Errorf("walk: want %v, have %v", want, visited)
+	}
+
+	m.RemoveAll("c")
+	if _, err := m.Stat("c/f"); !os.IsNotExist(err) {
+		t.Errorf("RemoveAll left c/f")
+	}
+}
+
+func TestDiskvMemFS(t *testing.T) {
+	d := New(Options{
+		BasePath:          "test-memfs",
+		AdvancedTransform: hashTransform,
+		InverseTransform:  hashInverseTransform,
+		CacheSizeMax:      1024,
+		Compression:       NewSnappyCompression(),
+		Index:             &BTreeIndex{},
+		IndexLess:         strLess,
+		FileSystem:        NewMemFS(),
+	})
+	if err := d.RegisterSecondaryIndex("first", func(key string, val []byte) []string {
+		return []string{string(val[:1])}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"a", "b", "c"} {
+		if err := d.WriteString(k, strings.Repeat(k, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Append("a", []byte("!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Clone("b", "b2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rename("c", "c2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Erase("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if have := collectKeys(t, d, ""); !cmpStrings(have, []string{"a", "b2", "c2"}) {
+		t.Errorf("keys: have %v", have)
+	}
+	if have := d.ReadString("a"); have != strings.Repeat("a", 100)+"!" {
+		t.Errorf("a: have %q", have)
+	}
+	rc, err := d.ReadRange("b2", 98, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(b, []byte("bb")) {
+		t.Errorf("range: have %q", b)
+	}
+	if keys, _ := d.Lookup("first", "c"); !cmpStrings(keys, []string{"c2"}) {
+		t.Errorf("lookup: have %v", keys)
+	}
+	if _, err := d.Snapshot("test-memfs-snapshot"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"test-memfs", "test-memfs-snapshot"} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s exists on disk", dir)
+		}
+	}
+	if err := d.EraseAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.FileSystem.Stat("test-memfs"); !os.IsNotExist(err) {
+		t.Errorf("EraseAll left the base path")
+	}
+}
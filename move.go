@@ -0,0 +1,192 @@
+package studydiskv
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Rename moves the value of oldKey to newKey, replacing any value there.
+func (d *Diskv) Rename(oldKey, newKey string) error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
+	oldPathKey, newPathKey, err := d.transformPair(oldKey, newKey)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	oldFilename := d.completeFilename(oldPathKey)
+	if err := d.statValue(oldFilename); err != nil || oldKey == newKey {
+		return err
+	}
+	if err := d.ensurePathWithLock(newPathKey); err != nil {
+		return fmt.Errorf("ensure path: %s", err)
+	}
+	d.preserveWithLock(oldKey)
+	d.preserveWithLock(newKey)
+	if err := d.FileSystem.Rename(oldFilename, d.completeFilename(newPathKey)); err != nil {
+		return fmt.Errorf("rename: %s", err)
+	}
+	d.pruneDirsWithLock(oldKey)
+	d.replicateWithLock(oldKey, false)
+
+	d.bustCacheWithLock(oldKey)
+	d.indexDeleteWithLock(oldKey)
+	if err := d.removeSecondaryWithLock(oldKey); err != nil {
+		return err
+	}
+	return d.addedWithLock(newPathKey)
+}
+
+// Copy copies the value of srcKey to dstKey as stored, without decoding
+// and re-encoding it.
+func (d *Diskv) Copy(srcKey, dstKey string) error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
+	srcPathKey, dstPathKey, err := d.transformPair(srcKey, dstKey)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.statValue(d.completeFilename(srcPathKey)); err != nil || srcKey == dstKey {
+		return err
+	}
+	if err := d.copyWithLock(srcPathKey, dstPathKey); err != nil {
+		return err
+	}
+	return d.addedWithLock(dstPathKey)
+}
+
+// Clone makes dstKey a hard link to the value of srcKey, falling back to
+// Copy where hard links are not possible. Later writes to either key
+// replace its file, and appends rewrite linked files, so the two values
+// stay independent.
+func (d *Diskv) Clone(srcKey, dstKey string) error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
+	srcPathKey, dstPathKey, err := d.transformPair(srcKey, dstKey)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	srcFilename := d.completeFilename(srcPathKey)
+	if err := d.statValue(srcFilename); err != nil || srcKey == dstKey {
+		return err
+	}
+	if err := d.ensurePathWithLock(dstPathKey); err != nil {
+		return fmt.Errorf("ensure path: %s", err)
+	}
+
+	tmp, err := d.linkTempWithLock(srcFilename)
+	if err != nil {
+		if err := d.copyWithLock(srcPathKey, dstPathKey); err != nil {
+			return err
+		}
+		return d.addedWithLock(dstPathKey)
+	}
+	d.preserveWithLock(dstKey)
+	if err := d.FileSystem.Rename(tmp, d.completeFilename(dstPathKey)); err != nil {
+		d.FileSystem.Remove(tmp)
+		return fmt.Errorf("rename: %s", err)
+	}
+	return d.addedWithLock(dstPathKey)
+}
+
+func (d *Diskv) transformPair(key1, key2 string) (*PathKey, *PathKey, error) {
+	if key1 == "" || key2 == "" {
+		return nil, nil, errEmpty
+	}
+	pathKey1, pathKey2 := d.transform(key1), d.transform(key2)
+	if err := d.validateKey(pathKey2); err != nil {
+		return nil, nil, err
+	}
+	return pathKey1, pathKey2, nil
+}
+
+func (d *Diskv) statValue(filename string) error {
+	fi, err := d.FileSystem.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errBadKey
+	}
+	return nil
+}
+
+func (d *Diskv) copyWithLock(srcPathKey, dstPathKey *PathKey) error {
+	src, err := openFile(d.FileSystem, d.completeFilename(srcPathKey))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return d.writeFileWithLock(dstPathKey, false, func(f io.Writer) error {
+		if _, err := io.Copy(f, src); err != nil {
+			return fmt.Errorf("i/o copy: %s", err)
+		}
+		return nil
+	})
+}
+
+// linkTempWithLock hard links filename into the store's staging directory
+// and returns the link's name.
+func (d *Diskv) linkTempWithLock(filename string) (string, error) {
+	dir := d.stagingDir()
+	if err := d.FileSystem.MkdirAll(dir, d.PathPerm); err != nil {
+		return "", err
+	}
+	f, err := d.FileSystem.TempFile(dir, stagingPrefix+"link-")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	d.FileSystem.Remove(f.Name())
+	if err := d.FileSystem.Link(filename, f.Name()); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// stagingPrefix begins the names of the temporary files a store creates.
+const stagingPrefix = "diskv-"
+
+func (d *Diskv) stagingDir() string {
+	return filepath.Join(d.BasePath, metaDir, "tmp")
+}
+
+// addedWithLock brings the cache and indexes up to date with a value that
+// was put in place at pathKey without going through writeStreamWithLock.
+func (d *Diskv) addedWithLock(pathKey *PathKey) error {
+	key := pathKey.originalKey
+	d.bustCacheWithLock(key)
+	d.indexInsertWithLock(key)
+	d.replicateWithLock(key, false)
+	if len(d.secondary) == 0 {
+		return d.changedWithLock()
+	}
+
+	rc, err := d.readValue(pathKey, d.compressionFor(key), nil)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	val, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	return d.updateSecondaryWithLock(key, val)
+}
@@ -0,0 +1,123 @@
+package studydiskv
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRename(t *testing.T) {
+	d := New(Options{
+		BasePath:          "test-rename",
+		AdvancedTransform: hashTransform,
+		InverseTransform:  hashInverseTransform,
+		CacheSizeMax:      1024,
+		Index:             &BTreeIndex{},
+		IndexLess:         strLess,
+	})
+	defer d.EraseAll()
+
+	if err := d.Write("old", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	d.ReadString("old")
+	if err := d.RegisterSecondaryIndex("val", func(key string, val []byte) []string {
+		return []string{string(val)}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Rename("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if d.Has("old") || d.isCache("old") || d.isIndexed("old") {
+		t.Errorf("old key still present")
+	}
+	if have := d.ReadString("new"); have != "value" {
+		t.Errorf("want %q, have %q", "value", have)
+	}
+	if !d.isIndexed("new") {
+		t.Errorf("new key not indexed")
+	}
+	if keys, _ := d.Lookup("val", "value"); !cmpStrings(keys, []string{"new"}) {
+		t.Errorf("lookup: have %v", keys)
+	}
+
+	oldDir := filepath.Join(d.BasePath, filepath.Join(hashTransform("old").Path...))
+	if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+		t.Errorf("%s not pruned", oldDir)
+	}
+
+	if err := d.Rename("missing", "other"); !os.IsNotExist(err) {
+		t.Errorf("want not-exist error, have %v", err)
+	}
+}
+
+func TestCopyClone(t *testing.T) {
+	for _, clone := range []bool{false, true} {
+		d := New(Options{
+			BasePath:     "test-copy",
+			Transform:    func(s string) []string { return strings.Split(s, "-")[:1] },
+			CacheSizeMax: 1024,
+			Compression:  NewZlibCompression(),
+			Index:        &BTreeIndex{},
+			IndexLess:    strLess,
+		})
+
+		if err := d.Write("a-src", []byte("shared")); err != nil {
+			t.Fatal(err)
+		}
+		copyFn := d.Copy
+		if clone {
+			copyFn = d.Clone
+		}
+		if err := copyFn("a-src", "b-dst"); err != nil {
+			t.Fatalf("clone=%v: %s", clone, err)
+		}
+		if have := d.ReadString("b-dst"); have != "shared" {
+			t.Errorf("clone=%v: want %q, have %q", clone, "shared", have)
+		}
+		if !d.isIndexed("b-dst") {
+			t.Errorf("clone=%v: not indexed", clone)
+		}
+
+		if err := d.Append("a-src", []byte("+a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Write("b-dst", []byte("b")); err != nil {
+			t.Fatal(err)
+		}
+		if have := d.ReadString("a-src"); have != "shared+a" {
+			t.Errorf("clone=%v: want %q, have %q", clone, "shared+a", have)
+		}
+		if have := d.ReadString("b-dst"); have != "b" {
+			t.Errorf("clone=%v: want %q, have %q", clone, "b", have)
+		}
+		d.EraseAll()
+	}
+}
+
+func TestCloneAppendRaw(t *testing.T) {
+	d := New(Options{
+		BasePath:     "test-clone",
+		CacheSizeMax: 1024,
+	})
+	defer d.EraseAll()
+
+	if err := d.Write("src", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Clone("src", "dst"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Append("dst", []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	if have := d.ReadString("src"); have != "one" {
+		t.Errorf("want %q, have %q", "one", have)
+	}
+	if have := d.ReadString("dst"); have != "onetwo" {
+		t.Errorf("want %q, have %q", "onetwo", have)
+	}
+}
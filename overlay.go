@@ -0,0 +1,296 @@
+package studydiskv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var errLayerTwice = errors.New("layer used twice")
+
+// Overlay layers a writable Diskv over read-only lower ones. Reads look
+// through the layers top down; writes go to the upper layer; erasing a key
+// a lower layer holds records a whiteout in the upper layer, hiding it
+// there. The lower layers are never written to, and may be opened
+// ReadOnly.
+type Overlay struct {
+	upper  *Diskv
+	lowers []*Diskv
+	path   string
+
+	mu        sync.RWMutex
+	whiteouts map[string]bool
+	ops       int
+}
+
+var _ Store = (*Overlay)(nil)
+
+// NewOverlay layers upper over lowers, the first of which is searched
+// first, loading any whiteouts recorded in upper.
+func NewOverlay(upper *Diskv, lowers ...*Diskv) (*Overlay, error) {
+	layers := append([]*Diskv{upper}, lowers...)
+	for i, a := range layers {
+		for _, b := range layers[i+1:] {
+			if a == b || a.BasePath == b.BasePath {
+				return nil, errLayerTwice
+			}
+		}
+	}
+
+	o := &Overlay{
+		upper:     upper,
+		lowers:    lowers,
+		path:      filepath.Join(upper.BasePath, metaDir, "whiteouts"),
+		whiteouts: map[string]bool{},
+	}
+	if err := o.load(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("whiteouts: %s", err)
+	}
+	return o, nil
+}
+
+// layerWithLock returns the layer key is read from, or nil if key is not
+// visible.
+func (o *Overlay) layerWithLock(key string) *Diskv {
+	if o.upper.Has(key) {
+		return o.upper
+	}
+	if o.whiteouts[key] {
+		return nil
+	}
+	for _, d := range o.lowers {
+		if d.Has(key) {
+			return d
+		}
+	}
+	return nil
+}
+
+func (o *Overlay) Read(key string) ([]byte, error) {
+	rc, err := o.ReadStream(key, false)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (o *Overlay) ReadStream(key string, direct bool) (io.ReadCloser, error) {
+	o.mu.RLock()
+	d := o.layerWithLock(key)
+	o.mu.RUnlock()
+	if d == nil {
+		return nil, &os.PathError{Op: "read", Path: key, Err: os.ErrNotExist}
+	}
+	return d.ReadStream(key, direct)
+}
+
+func (o *Overlay) Write(key string, val []byte) error {
+	return o.WriteStream(key, bytes.NewReader(val), false)
+}
+
+// WriteStream writes key to the upper layer, dropping any whiteout of it.
+func (o *Overlay) WriteStream(key string, r io.Reader, sync bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.upper.WriteStream(key, r, sync); err != nil {
+		return err
+	}
+	if !o.whiteouts[key] {
+		return nil
+	}
+	delete(o.whiteouts, key)
+	return o.persistWithLock(journalOp{add: false, key: key})
+}
+
+// Erase erases key from the upper layer and, if a lower layer holds it,
+// records a whiteout hiding it.
+func (o *Overlay) Erase(key string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	err := o.upper.Erase(key)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if o.whiteouts[key] {
+		return err
+	}
+	for _, d := range o.lowers {
+		if d.Has(key) {
+			o.whiteouts[key] = true
+			return o.persistWithLock(journalOp{add: true, key: key})
+		}
+	}
+	return err
+}
+
+func (o *Overlay) Has(key string) bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.layerWithLock(key) != nil
+}
+
+func (o *Overlay) Keys(cancel <-chan struct{}) <-chan string {
+	return o.KeysPrefix("", cancel)
+}
+
+func (o *Overlay) KeysPrefix(prefix string, cancel <-chan struct{}) <-chan string {
+	return keysChan(o.KeysSeq(prefix), cancel)
+}
+
+// KeysSeq yields every visible key beginning with prefix, from all layers,
+// in lexical order.
+func (o *Overlay) KeysSeq(prefix string) iter.Seq2[string, error] {
+	seqs := []iter.Seq2[string, error]{o.upper.walkKeys(prefix)}
+	for _, d := range o.lowers {
+		seqs = append(seqs, d.walkKeys(prefix))
+	}
+	return func(yield func(string, error) bool) {
+		for key, err := range mergeKeys(seqs) {
+			if err == nil && o.whitedOut(key) {
+				continue
+			}
+			if !yield(key, err) {
+				return
+			}
+		}
+	}
+}
+
+// whitedOut reports whether key is hidden by a whiteout. Keys written
+// since they were erased are not.
+func (o *Overlay) whitedOut(key string) bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.whiteouts[key] && !o.upper.Has(key)
+}
+
+// Flatten copies every key visible through the overlay into dst. With the
+// upper layer as dst, the lower layers' keys are copied up, leaving the
+// upper layer standing alone, and whiteouts are dropped but for those
+// still hiding a key of a lower layer, as one erased meanwhile does. A
+// ReadOnly dst is refused with ErrReadOnly.
+func (o *Overlay) Flatten(ctx context.Context, dst *Diskv) error {
+	if dst.ReadOnly {
+		return ErrReadOnly
+	}
+	for _, d := range o.lowers {
+		if d == dst || d.BasePath == dst.BasePath {
+			return errLayerTwice
+		}
+	}
+
+	for key, err := range o.KeysSeq("") {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		o.mu.RLock()
+		src := o.layerWithLock(key)
+		o.mu.RUnlock()
+		if src == nil || src == dst {
+			continue // erased meanwhile, or already there
+		}
+		if _, err := copyValue(src, dst, key); err != nil {
+			return fmt.Errorf("copy %s: %s", key, err)
+		}
+	}
+
+	if dst != o.upper {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for key := range o.whiteouts {
+		if o.upper.Has(key) || !o.lowerHas(key) {
+			delete(o.whiteouts, key)
+		}
+	}
+	if len(o.whiteouts) > 0 {
+		return o.compactWithLock()
+	}
+	o.ops = 0
+	if err := o.upper.FileSystem.Remove(o.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// lowerHas reports whether any lower layer holds key.
+func (o *Overlay) lowerHas(key string) bool {
+	for _, d := range o.lowers {
+		if d.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// persistWithLock appends op to the whiteout journal, first rewriting the
+// journal if it has grown well beyond the whiteouts it records.
+func (o *Overlay) persistWithLock(op journalOp) error {
+	fsys := o.upper.FileSystem
+	o.ops++
+	if o.ops > 2*len(o.whiteouts)+1024 {
+		return o.compactWithLock()
+	}
+
+	if err := fsys.MkdirAll(filepath.Dir(o.path), o.upper.PathPerm); err != nil {
+		return err
+	}
+	f, err := fsys.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, o.upper.FilePerm)
+	if err != nil {
+		return err
+	}
+	if err := writeJournal(f, []journalOp{op}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// compactWithLock rewrites the journal to record just the whiteouts.
+func (o *Overlay) compactWithLock() error {
+	ops := []journalOp{}
+	for key := range o.whiteouts {
+		ops = append(ops, journalOp{add: true, key: key})
+	}
+	o.ops = len(ops)
+	return writeFileAtomic(o.upper.FileSystem, o.path, o.upper.PathPerm, o.upper.FilePerm, func(f io.Writer) error {
+		return writeJournal(f, ops)
+	})
+}
+
+func (o *Overlay) load() error {
+	f, err := openFile(o.upper.FileSystem, o.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		op, err := parseJournalOp(scanner.Text())
+		if err != nil {
+			return err
+		}
+		if op.add {
+			o.whiteouts[op.key] = true
+		} else {
+			delete(o.whiteouts, op.key)
+		}
+		o.ops++
+	}
+	return scanner.Err()
+}
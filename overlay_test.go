@@ -0,0 +1,217 @@
+package studydiskv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	base := New(Options{BasePath: "test-overlay-base"})
+	defer base.EraseAll()
+	fixture := New(Options{BasePath: "test-overlay-fixture", Compression: NewGzipCompression()})
+	defer fixture.EraseAll()
+	upper := New(Options{BasePath: "test-overlay-upper"})
+	defer upper.EraseAll()
+
+	base.WriteString("a", "base")
+	base.WriteString("b", "base")
+	base.WriteString("c", "base")
+	fixture.WriteString("b", "fixture")
+
+	o, err := NewOverlay(upper, fixture, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"a": "base", "b": "fixture"} {
+		if val, err := o.Read(key); err != nil || string(val) != want {
+			t.Errorf("%s: want %q, have %q, %v", key, want, val, err)
+		}
+	}
+
+	o.Write("a", []byte("upper"))
+	o.Write("d", []byte("upper"))
+	if err := o.Erase("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Erase("d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Erase("d"); !os.IsNotExist(err) {
+		t.Errorf("erase missing key: %v", err)
+	}
+	if err := o.Erase("b"); !os.IsNotExist(err) {
+		t.Errorf("erase whited out key: %v", err)
+	}
+
+	check := func(o *Overlay, want map[string]string) {
+		t.Helper()
+		keys := []string{}
+		for _, key := range []string{"a", "b", "c", "d"} {
+			if _, ok := want[key]; ok {
+				keys = append(keys, key)
+			}
+		}
+		if have := collectKeys(t, o, ""); !cmpStrings(have, keys) {
+			t.Errorf("keys: want %v, have %v", keys, have)
+		}
+		for _, key := range []string{"a", "b", "c", "d"} {
+			val, err := o.Read(key)
+			if w, ok := want[key]; !ok {
+				if !os.IsNotExist(err) || o.Has(key) {
+					t.Errorf("%s: visible: %q, %v", key, val, err)
+				}
+			} else if err != nil || string(val) != w {
+				t.Errorf("%s: want %q, have %q, %v", key, w, val, err)
+			}
+		}
+	}
+	want := map[string]string{"a": "upper", "c": "base"}
+	check(o, want)
+
+	// The lower layers are untouched, and whiteouts persist.
+	if base.ReadString("a") != "base" || fixture.ReadString("b") != "fixture" {
+		t.Errorf("lower layer written to")
+	}
+	reopened, err := NewOverlay(upper, fixture, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(reopened, want)
+
+	// Writing a whited out key makes it visible again.
+	reopened.Write("b", []byte("again"))
+	want["b"] = "again"
+	check(reopened, want)
+	reopened.Erase("b")
+	delete(want, "b")
+
+	flat := New(Options{BasePath: "test-overlay-flat"})
+	defer flat.EraseAll()
+	if err := reopened.Flatten(context.Background(), flat); err != nil {
+		t.Fatal(err)
+	}
+	alone, _ := NewOverlay(flat)
+	check(alone, want)
+
+	if err := reopened.Flatten(context.Background(), upper); err != nil {
+		t.Fatal(err)
+	}
+	alone, _ = NewOverlay(upper)
+	check(alone, want)
+
+	if _, err := NewOverlay(upper, base, base); err != errLayerTwice {
+		t.Errorf("want %v, have %v", errLayerTwice, err)
+	}
+	if err := o.Flatten(context.Background(), base); err != errLayerTwice {
+		t.Errorf("flatten into lower layer: want %v, have %v", errLayerTwice, err)
+	}
+}
+
+func TestOverlayPermissions(t *testing.T) {
+	base := New(Options{BasePath: "test-overlay-perm-base"})
+	defer base.EraseAll()
+	upper := New(Options{BasePath: "test-overlay-perm-upper", PathPerm: 0750, FilePerm: 0640})
+	defer upper.EraseAll()
+
+	base.WriteString("a", "base")
+	o, err := NewOverlay(upper, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Erase("a"); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]os.FileMode{filepath.Dir(o.path): 0750, o.path: 0640} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := fi.Mode().Perm(); have != want {
+			t.Errorf("%s: want %v, have %v", path, want, have)
+		}
+	}
+}
+
+// openHookFS calls hook before opening a file named name.
+type openHookFS struct {
+	FS
+	name string
+	hook func()
+}
+
+func (f *openHookFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if filepath.Base(name) == f.name && f.hook != nil {
+		hook := f.hook
+		f.hook = nil
+		hook()
+	}
+	return f.FS.OpenFile(name, flag, perm)
+}
+
+func TestOverlayFlattenErase(t *testing.T) {
+	lowerFS := &openHookFS{FS: NewMemFS(), name: "c"}
+	lower := New(Options{BasePath: "test-overlay-lower", FileSystem: lowerFS})
+	upper := New(Options{BasePath: "test-overlay-upper", FileSystem: NewMemFS()})
+	for _, key := range []string{"a", "b", "c", "d"} {
+		lower.WriteString(key, "lower")
+	}
+	o, err := NewOverlay(upper, lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Erase("b")
+
+	// While c is copied up, one key already copied and one not yet are
+	// erased; both stay hidden.
+	lowerFS.hook = func() {
+		for _, key := range []string{"a", "d"} {
+			if err := o.Erase(key); err != nil {
+				t.Errorf("erase %s: %v", key, err)
+			}
+		}
+	}
+	if err := o.Flatten(context.Background(), upper); err != nil {
+		t.Fatal(err)
+	}
+	for _, ov := range []*Overlay{o, mustOverlay(t, upper, lower)} {
+		if have := collectKeys(t, ov, ""); !cmpStrings(have, []string{"c"}) {
+			t.Errorf("want [c], have %v", have)
+		}
+	}
+	if have := collectKeys(t, upper, ""); !cmpStrings(have, []string{"c"}) {
+		t.Errorf("upper: want [c], have %v", have)
+	}
+}
+
+func TestOverlayFlattenReadOnly(t *testing.T) {
+	fsys := NewMemFS()
+	lower := New(Options{BasePath: "test-overlay-lower", FileSystem: NewMemFS()})
+	upper := New(Options{BasePath: "test-overlay-upper", FileSystem: fsys})
+	lower.WriteString("a", "lower")
+	lower.WriteString("b", "lower")
+	mustOverlay(t, upper, lower).Erase("b")
+	before := listFiles(t, fsys, upper.BasePath)
+
+	upper = New(Options{BasePath: "test-overlay-upper", FileSystem: fsys, ReadOnly: true})
+	o := mustOverlay(t, upper, lower)
+	if err := o.Flatten(context.Background(), upper); err != ErrReadOnly {
+		t.Errorf("want %v, have %v", ErrReadOnly, err)
+	}
+	if have := listFiles(t, fsys, upper.BasePath); !cmpStrings(have, before) {
+		t.Errorf("upper changed: want %v, have %v", before, have)
+	}
+	if have := collectKeys(t, o, ""); !cmpStrings(have, []string{"a"}) {
+		t.Errorf("want [a], have %v", have)
+	}
+}
+
+func mustOverlay(t *testing.T, upper *Diskv, lowers ...*Diskv) *Overlay {
+	t.Helper()
+	o, err := NewOverlay(upper, lowers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
@@ -0,0 +1,146 @@
+package studydiskv
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// noWriteFS fails the test on any call that would change the file system.
+type noWriteFS struct {
+	FS
+	t *testing.T
+}
+
+func (f noWriteFS) fail(op, name string) error {
+	f.t.Errorf("%s %s on a read-only store", op, name)
+	return ErrReadOnly
+}
+
+func (f noWriteFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag != os.O_RDONLY {
+		return nil, f.fail("OpenFile", name)
+	}
+	return f.FS.OpenFile(name, flag, perm)
+}
+
+func (f noWriteFS) TempFile(dir, pattern string) (File, error) {
+	return nil, f.fail("TempFile", dir)
+}
+func (f noWriteFS) Rename(oldpath, newpath string) error { return f.fail("Rename", newpath) }
+func (f noWriteFS) Link(oldname, newname string) error   { return f.fail("Link", newname) }
+func (f noWriteFS) MkdirAll(path string, perm os.FileMode) error {
+	return f.fail("MkdirAll", path)
+}
+func (f noWriteFS) Remove(name string) error                  { return f.fail("Remove", name) }
+func (f noWriteFS) RemoveAll(path string) error               { return f.fail("RemoveAll", path) }
+func (f noWriteFS) Chmod(name string, mode os.FileMode) error { return f.fail("Chmod", name) }
+func (f noWriteFS) Chtimes(name string, atime, mtime time.Time) error {
+	return f.fail("Chtimes", name)
+}
+
+func TestReadOnly(t *testing.T) {
+	mem := NewMemFS()
+	opts := Options{
+		BasePath:    "test-readonly",
+		TempDir:     "test-readonly-tmp",
+		Compression: NewGzipCompression(),
+		FileSystem:  mem,
+	}
+	w := New(opts)
+	w.WriteString("a", "apple")
+	w.WriteString("b", "banana")
+	mem.RemoveAll(opts.TempDir)
+	before := listFiles(t, mem, "test-readonly")
+
+	opts.ReadOnly = true
+	opts.FileSystem = noWriteFS{mem, t}
+	opts.Index, opts.IndexLess = &BTreeIndex{}, strLess
+	d := New(opts)
+	other := New(Options{BasePath: "test-readonly-other", FileSystem: NewMemFS()})
+
+	for name, mutate := range map[string]func() error{
+		"Write":         func() error { return d.Write("c", []byte("x")) },
+		"WriteString":   func() error { return d.WriteString("a", "x") },
+		"WriteStream":   func() error { return d.WriteStream("a", strings.NewReader("x"), true) },
+		"Append":        func() error { return d.Append("a", []byte("x")) },
+		"AppendStream":  func() error { return d.AppendStream("c", strings.NewReader("x"), false) },
+		"Import":        func() error { return d.Import("test-readonly/a", "c", false) },
+		"ImportDir":     func() error { return d.ImportDir("test-readonly", nil, true) },
+		"ImportArchive": func() error { return d.ImportArchive(context.Background(), &bytes.Buffer{}) },
+		"Recompress":    func() error { return d.Recompress(context.Background(), NewZlibCompression()) },
+		"Erase":         func() error { return d.Erase("a") },
+		"EraseAll":      func() error { return d.EraseAll() },
+		"Rename":        func() error { return d.Rename("a", "c") },
+		"Copy":          func() error { return d.Copy("a", "c") },
+		"Clone":         func() error { return d.Clone("a", "c") },
+		"AddDictionary": func() error { return d.AddDictionary(NewDictionary([]byte("apple banana"))) },
+		"NewReplicator": func() error {
+			_, err := NewReplicator(other, d, 0)
+			return err
+		},
+		"Sync": func() error {
+			_, err := Sync(context.Background(), other, d, CompareSize)
+			return err
+		},
+	} {
+		if err := mutate(); err != ErrReadOnly {
+			t.Errorf("%s: want %v, have %v", name, ErrReadOnly, err)
+		}
+	}
+
+	h := NewHandler(d)
+	for _, method := range []string{"PUT", "DELETE"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/keys/a", strings.NewReader("x")))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: want %d, have %d", method, http.StatusForbidden, rec.Code)
+		}
+	}
+
+	// Everything that only reads still works.
+	if err := d.RegisterSecondaryIndex("first", func(key string, val []byte) []string {
+		return []string{string(val[:1])}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := d.Lookup("first", "b"); !cmpStrings(keys, []string{"b"}) {
+		t.Errorf("lookup: have %v", keys)
+	}
+	if keys := collectKeys(t, d, ""); !cmpStrings(keys, []string{"a", "b"}) {
+		t.Errorf("keys: have %v", keys)
+	}
+	for key, want := range map[string]string{"a": "apple", "b": "banana"} {
+		if val, err := d.Read(key); err != nil || string(val) != want {
+			t.Errorf("%s: want %q, have %q, %v", key, want, val, err)
+		}
+		h, err := d.Open(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, _ := io.ReadAll(h)
+		h.Close()
+		if string(val) != want {
+			t.Errorf("%s: open: want %q, have %q", key, want, val)
+		}
+	}
+	if _, err := d.Stat("a"); err != nil {
+		t.Error(err)
+	}
+	if err := d.Export(context.Background(), io.Discard, ""); err != nil {
+		t.Error(err)
+	}
+
+	if after := listFiles(t, mem, "test-readonly"); !cmpStrings(after, before) {
+		t.Errorf("files: want %v, have %v", before, after)
+	}
+	if _, err := mem.Stat("test-readonly-tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp dir created: %v", err)
+	}
+}
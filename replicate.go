@@ -0,0 +1,365 @@
+package studydiskv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	errReplicaSelf  = errors.New("cannot replicate a store onto itself")
+	errReplicaCycle = errors.New("replication would lead back to the source")
+)
+
+// Replicator mirrors the writes and erases made on one Diskv onto another.
+// It mirrors each key as it is once a change has been made to it, so a
+// queued Replicator only copies a key once however often it changes
+// before its turn comes.
+type Replicator struct {
+	src, dst *Diskv
+	queued   bool
+	size     int
+	done     chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond      // signalled when changes are queued or copied
+	pending map[string]bool // keys changed since last copied
+	all     bool            // every key erased since last copied
+	closed  bool
+	err     error
+}
+
+type replicaOp struct {
+	key string
+	all bool
+}
+
+// NewReplicator starts mirroring src onto dst. With a queueSize of 0 each
+// change is copied before the call making it returns; otherwise changed
+// keys are queued and copied in the background, and writers to src wait
+// while queueSize keys are waiting.
+func NewReplicator(src, dst *Diskv, queueSize int) (*Replicator, error) {
+	if src == dst || src.BasePath == dst.BasePath {
+		return nil, errReplicaSelf
+	}
+	if dst.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if replicatesTo(dst, src, map[*Diskv]bool{}) {
+		return nil, errReplicaCycle
+	}
+	r := &Replicator{src: src, dst: dst, pending: map[string]bool{}}
+	r.cond = sync.NewCond(&r.mu)
+	if queueSize > 0 {
+		r.queued, r.size = true, queueSize
+		r.done = make(chan struct{})
+		go r.run()
+	}
+
+	src.mu.Lock()
+	src.replicas = append(src.replicas, r)
+	src.mu.Unlock()
+	return r, nil
+}
+
+// Err returns the first error met while mirroring.
+func (r *Replicator) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Close stops mirroring, waits for queued changes to be copied and returns
+// the first error met while mirroring.
+func (r *Replicator) Close() error {
+	r.src.mu.Lock()
+	replicas := r.src.replicas[:0]
+	for _, other := range r.src.replicas {
+		if other != r {
+			replicas = append(replicas, other)
+		}
+	}
+	r.src.replicas = replicas
+	r.src.mu.Unlock()
+
+	if r.queued {
+		r.mu.Lock()
+		r.closed = true
+		r.cond.Broadcast()
+		r.mu.Unlock()
+		<-r.done
+	}
+	return r.Err()
+}
+
+// enqueue queues op, waiting while the queue is full.
+func (r *Replicator) enqueue(op replicaOp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if op.all {
+		// Erasing every key makes earlier changes moot.
+		r.all, r.pending = true, map[string]bool{}
+	} else {
+		for len(r.pending) >= r.size && !r.pending[op.key] {
+			r.cond.Wait()
+		}
+		r.pending[op.key] = true
+	}
+	r.cond.Broadcast()
+}
+
+func (r *Replicator) run() {
+	defer close(r.done)
+	for {
+		r.mu.Lock()
+		for !r.all && len(r.pending) == 0 && !r.closed {
+			r.cond.Wait()
+		}
+		all, pending := r.all, r.pending
+		r.all, r.pending = false, map[string]bool{}
+		r.cond.Broadcast()
+		r.mu.Unlock()
+
+		if !all && len(pending) == 0 {
+			return // closed, with nothing left to copy
+		}
+		if all {
+			r.apply(replicaOp{all: true})
+		}
+		for key := range pending {
+			r.apply(replicaOp{key: key})
+		}
+	}
+}
+
+func (r *Replicator) apply(op replicaOp) {
+	var err error
+	if op.all {
+		err = r.dst.EraseAll()
+	} else {
+		_, err = copyValue(r.src, r.dst, op.key)
+	}
+	if err != nil {
+		r.mu.Lock()
+		if r.err == nil {
+			r.err = fmt.Errorf("replicate %s: %s", op.key, err)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// replicatesTo reports whether changes to d reach target through d's
+// replicas, or theirs in turn.
+func replicatesTo(d, target *Diskv, seen map[*Diskv]bool) bool {
+	if d == target || d.BasePath == target.BasePath {
+		return true
+	}
+	if seen[d] {
+		return false
+	}
+	seen[d] = true
+
+	d.mu.RLock()
+	replicas := append([]*Replicator(nil), d.replicas...)
+	d.mu.RUnlock()
+	for _, r := range replicas {
+		if replicatesTo(r.dst, target, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// replicateWithLock hands a change to key, or to every key if all is set,
+// to the store's replicas.
+func (d *Diskv) replicateWithLock(key string, all bool) {
+	for _, r := range d.replicas {
+		op := replicaOp{key: key, all: all}
+		if r.queued {
+			r.enqueue(op)
+		} else {
+			r.apply(op)
+		}
+	}
+}
+
+// copyValue makes key in dst what it is in src, erasing it from dst if src
+// has no such key. It reports whether src had the key. It reads src without
+// taking its lock, so it may be called while holding it.
+func copyValue(src, dst *Diskv, key string) (bool, error) {
+	pathKey := src.transform(key)
+	filename := src.completeFilename(pathKey)
+	fi, err := src.FileSystem.Stat(filename)
+	if os.IsNotExist(err) {
+		if err := dst.Erase(key); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	rc, err := src.readValue(pathKey, src.compressionFor(key), nil)
+	if os.IsNotExist(err) {
+		return copyValue(src, dst, key)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	if err := dst.WriteStream(key, rc, false); err != nil {
+		return true, err
+	}
+	// Keep modification times equal, so that Sync can compare them.
+	dstFilename := dst.completeFilename(dst.transform(key))
+	return true, dst.FileSystem.Chtimes(dstFilename, fi.ModTime(), fi.ModTime())
+}
+
+// Compare is how Sync decides that a value differs between two stores.
+type Compare int
+
+const (
+	// CompareSize compares the sizes of the decompressed values.
+	CompareSize Compare = iota
+	// CompareModTime compares modification times, which Sync and
+	// Replicator carry over, as well as sizes.
+	CompareModTime
+	// CompareChecksum compares SHA-256 checksums of the values.
+	CompareChecksum
+)
+
+// SyncReport lists, in sorted order, the keys Sync added to, changed in
+// and removed from the destination.
+type SyncReport struct {
+	Added, Changed, Removed []string
+}
+
+// Sync makes dst hold the same keys and values as src, copying what cmp
+// finds to differ and removing keys src does not have.
+func Sync(ctx context.Context, src, dst *Diskv, cmp Compare) (*SyncReport, error) {
+	if src == dst || src.BasePath == dst.BasePath {
+		return nil, errReplicaSelf
+	}
+	if dst.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	report := &SyncReport{}
+	seen := map[string]bool{}
+	for key, err := range src.walkKeys("") {
+		if err != nil {
+			return report, err
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		seen[key] = true
+
+		added := !dst.Has(key)
+		if !added {
+			same, err := sameValue(src, dst, key, cmp)
+			if err != nil {
+				return report, fmt.Errorf("compare %s: %s", key, err)
+			}
+			if same {
+				continue
+			}
+		}
+
+		ok, err := copyValue(src, dst, key)
+		if err != nil {
+			return report, fmt.Errorf("copy %s: %s", key, err)
+		}
+		switch {
+		case !ok: // erased from src since it was listed
+		case added:
+			report.Added = append(report.Added, key)
+		default:
+			report.Changed = append(report.Changed, key)
+		}
+	}
+
+	for key, err := range dst.walkKeys("") {
+		if err != nil {
+			return report, err
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if seen[key] {
+			continue
+		}
+		if err := dst.Erase(key); err != nil && !os.IsNotExist(err) {
+			return report, fmt.Errorf("erase %s: %s", key, err)
+		}
+		report.Removed = append(report.Removed, key)
+	}
+	return report, nil
+}
+
+func sameValue(src, dst *Diskv, key string, cmp Compare) (bool, error) {
+	if cmp == CompareChecksum {
+		a, err := valueChecksum(src, key)
+		if err != nil {
+			return false, err
+		}
+		b, err := valueChecksum(dst, key)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(a, b), nil
+	}
+
+	if cmp == CompareModTime {
+		a, err := src.FileSystem.Stat(src.completeFilename(src.transform(key)))
+		if err != nil {
+			return false, err
+		}
+		b, err := dst.FileSystem.Stat(dst.completeFilename(dst.transform(key)))
+		if err != nil {
+			return false, err
+		}
+		if !a.ModTime().Equal(b.ModTime()) {
+			return false, nil
+		}
+	}
+
+	a, err := valueSize(src, key)
+	if err != nil {
+		return false, err
+	}
+	b, err := valueSize(dst, key)
+	if err != nil {
+		return false, err
+	}
+	return a == b, nil
+}
+
+func valueSize(d *Diskv, key string) (int64, error) {
+	h, err := d.Open(key)
+	if err != nil {
+		return 0, err
+	}
+	defer h.Close()
+	return h.Size()
+}
+
+func valueChecksum(d *Diskv, key string) ([]byte, error) {
+	// Read around the cache, so comparing leaves it as it was.
+	rc, err := d.readValue(d.transform(key), d.compressionFor(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
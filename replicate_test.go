@@ -0,0 +1,200 @@
+package studydiskv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplicator(t *testing.T) {
+	for _, queueSize := range []int{0, 4} {
+		src := New(Options{
+			BasePath:    "test-replicate-src",
+			Compression: NewGzipCompression(),
+		})
+		dst := New(Options{
+			BasePath:          "test-replicate-dst",
+			AdvancedTransform: hashTransform,
+			InverseTransform:  hashInverseTransform,
+		})
+
+		r, err := NewReplicator(src, dst, queueSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			src.WriteString(fmt.Sprintf("k%02d", i), fmt.Sprint(i))
+		}
+		src.Append("k00", []byte("+"))
+		src.Rename("k01", "moved")
+		src.Erase("k02")
+		if err := r.Close(); err != nil {
+			t.Fatalf("queue %d: %s", queueSize, err)
+		}
+		want := collectKeys(t, src, "")
+		src.WriteString("after", "close")
+
+		if have := collectKeys(t, dst, ""); !cmpStrings(have, want) {
+			t.Errorf("queue %d: want %v, have %v", queueSize, want, have)
+		}
+		for _, key := range want {
+			if a, b := src.ReadString(key), dst.ReadString(key); a != b {
+				t.Errorf("queue %d: %s: want %q, have %q", queueSize, key, a, b)
+			}
+		}
+		src.EraseAll()
+		dst.EraseAll()
+	}
+
+	d := New(Options{BasePath: "test-replicate-src"})
+	if _, err := NewReplicator(d, d, 0); err != errReplicaSelf {
+		t.Errorf("want %v, have %v", errReplicaSelf, err)
+	}
+
+	a := New(Options{BasePath: "test-replicate-a", FileSystem: NewMemFS()})
+	b := New(Options{BasePath: "test-replicate-b", FileSystem: NewMemFS()})
+	c := New(Options{BasePath: "test-replicate-c", FileSystem: NewMemFS()})
+	ab, err := NewReplicator(a, b, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := NewReplicator(b, c, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dst := range []*Diskv{a, b} {
+		if _, err := NewReplicator(c, dst, 0); err != errReplicaCycle {
+			t.Errorf("%s: want %v, have %v", dst.BasePath, errReplicaCycle, err)
+		}
+	}
+	bc.Close()
+	ab.Close()
+	if _, err := NewReplicator(c, a, 0); err != nil {
+		t.Errorf("after closing: %v", err)
+	}
+}
+
+// gateFS holds every TempFile call until the gate is opened, and counts
+// the files renamed into place by name.
+type gateFS struct {
+	FS
+	gate chan struct{}
+
+	mu      sync.Mutex
+	renamed map[string]int
+}
+
+func (f *gateFS) TempFile(dir, pattern string) (File, error) {
+	<-f.gate
+	return f.FS.TempFile(dir, pattern)
+}
+
+func (f *gateFS) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	f.renamed[filepath.Base(newpath)]++
+	f.mu.Unlock()
+	return f.FS.Rename(oldpath, newpath)
+}
+
+func TestReplicatorCoalesces(t *testing.T) {
+	src := New(Options{BasePath: "test-replicate-src", FileSystem: NewMemFS()})
+	dstFS := &gateFS{FS: NewMemFS(), gate: make(chan struct{}), renamed: map[string]int{}}
+	dst := New(Options{BasePath: "test-replicate-dst", FileSystem: dstFS})
+	r, err := NewReplicator(src, dst, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first copy holds up the queue while k changes ten times.
+	src.WriteString("first", "x")
+	for i := 0; i < 10; i++ {
+		src.WriteString("k", fmt.Sprint(i))
+	}
+	close(dstFS.gate)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if have := dst.ReadString("k"); have != "9" {
+		t.Errorf("want %q, have %q", "9", have)
+	}
+	if n := dstFS.renamed["k"]; n != 1 {
+		t.Errorf("k copied %d times", n)
+	}
+}
+
+func TestSync(t *testing.T) {
+	src := New(Options{BasePath: "test-sync-src", Compression: NewZlibCompression()})
+	defer src.EraseAll()
+	dst := New(Options{BasePath: "test-sync-dst"})
+	defer dst.EraseAll()
+
+	for _, k := range []string{"a", "b", "c"} {
+		src.WriteString(k, "value-"+k)
+	}
+	dst.WriteString("b", "other-b") // same size, different content
+	dst.WriteString("z", "stale")
+
+	report, err := Sync(context.Background(), src, dst, CompareSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmpStrings(report.Added, []string{"a", "c"}) || len(report.Changed) != 0 || !cmpStrings(report.Removed, []string{"z"}) {
+		t.Errorf("by size: have %+v", report)
+	}
+
+	report, err = Sync(context.Background(), src, dst, CompareChecksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmpStrings(report.Changed, []string{"b"}) || len(report.Added)+len(report.Removed) != 0 {
+		t.Errorf("by checksum: have %+v", report)
+	}
+	if have := dst.ReadString("b"); have != "value-b" {
+		t.Errorf("want %q, have %q", "value-b", have)
+	}
+
+	mtime := time.Now().Add(time.Hour)
+	os.Chtimes(src.completeFilename(src.transform("c")), mtime, mtime)
+	report, err = Sync(context.Background(), src, dst, CompareModTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmpStrings(report.Changed, []string{"c"}) || len(report.Added)+len(report.Removed) != 0 {
+		t.Errorf("by mtime: have %+v", report)
+	}
+
+	report, err = Sync(context.Background(), src, dst, CompareModTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Added)+len(report.Changed)+len(report.Removed) != 0 {
+		t.Errorf("in sync: have %+v", report)
+	}
+
+	// Comparing checksums reads around the cache, neither filling it nor
+	// evicting from it.
+	cached := New(Options{BasePath: "test-sync-cached", CacheSizeMax: 1024})
+	defer cached.EraseAll()
+	other := New(Options{BasePath: "test-sync-other"})
+	defer other.EraseAll()
+	cached.WriteString("a", "value-a")
+	cached.WriteString("b", "value-b")
+	cached.ReadString("a")
+	other.WriteString("a", "value-a")
+	other.WriteString("b", "value-b")
+	if _, err := Sync(context.Background(), cached, other, CompareChecksum); err != nil {
+		t.Fatal(err)
+	}
+	cached.mu.RLock()
+	_, aCached := cached.cache["a"]
+	_, bCached := cached.cache["b"]
+	cached.mu.RUnlock()
+	if !aCached || bCached {
+		t.Errorf("want only a cached, have a %v, b %v", aCached, bCached)
+	}
+}
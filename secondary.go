@@ -0,0 +1,534 @@
+package studydiskv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/btree"
+)
+
+var (
+	errNoSuchIndex    = errors.New("no such secondary index")
+	errIndexExists    = errors.New("secondary index already registered")
+	errBadIndexName   = errors.New("bad secondary index name")
+	errCorruptJournal = errors.New("corrupt secondary index journal")
+	errCorruptChanges = errors.New("corrupt change counter")
+)
+
+// changesName is the file, beside the journals, counting the changes made
+// to the store while some persisted index was not registered.
+const changesName = "changes"
+
+// Extractor returns the terms under which a value is indexed.
+type Extractor func(key string, val []byte) []string
+
+type termItem struct {
+	term string
+	keys map[string]struct{}
+}
+
+func (t *termItem) Less(i btree.Item) bool {
+	return t.term < i.(*termItem).term
+}
+
+type secondaryIndex struct {
+	sync.RWMutex
+	extract  Extractor
+	fs       FS
+	path     string
+	pathPerm os.FileMode
+	filePerm os.FileMode
+	terms    *btree.BTree
+	byKey    map[string][]string
+	entries  int
+	ops      int
+	changes  uint64 // the store's change count the index is up to date with
+}
+
+func newSecondaryIndex(d *Diskv, name string, extract Extractor) *secondaryIndex {
+	return &secondaryIndex{
+		extract:  extract,
+		fs:       d.FileSystem,
+		path:     filepath.Join(d.indexDir(), name+".journal"),
+		pathPerm: d.PathPerm,
+		filePerm: d.FilePerm,
+		terms:    btree.New(2),
+		byKey:    map[string][]string{},
+	}
+}
+
+// RegisterSecondaryIndex adds an index, named name, mapping the terms
+// returned by extract to keys. The index is persisted under BasePath and
+// kept up to date by Write and Erase; if nothing has been persisted yet, or
+// the store has changed while the index was not registered, it is built by
+// reading every value in the store, and persisted unless the store is
+// ReadOnly.
+func (d *Diskv) RegisterSecondaryIndex(name string, extract Extractor) error {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return errBadIndexName
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.secondary[name]; ok {
+		return errIndexExists
+	}
+
+	si := newSecondaryIndex(d, name, extract)
+	err := si.load()
+	if err == nil {
+		var fresh bool
+		if fresh, err = d.secondaryFresh(si); err == nil && !fresh {
+			si.reset()
+			err = d.buildSecondaryWithLock(si)
+		}
+	} else if os.IsNotExist(err) {
+		err = d.buildSecondaryWithLock(si)
+	}
+	if err != nil {
+		return fmt.Errorf("secondary index %s: %s", name, err)
+	}
+
+	if d.secondary == nil {
+		d.secondary = map[string]*secondaryIndex{}
+	}
+	d.secondary[name] = si
+	d.journals = nil // listed again on the next change
+	return nil
+}
+
+// Lookup returns the keys indexed under term, in sorted order.
+func (d *Diskv) Lookup(name, term string) ([]string, error) {
+	return d.LookupRange(name, term, term+"\x00")
+}
+
+// LookupRange returns the keys indexed under any term in [from, to), in
+// sorted order. An empty to means no upper bound.
+func (d *Diskv) LookupRange(name, from, to string) ([]string, error) {
+	d.mu.RLock()
+	si, ok := d.secondary[name]
+	d.mu.RUnlock()
+	if !ok {
+		return nil, errNoSuchIndex
+	}
+	return si.lookup(from, to), nil
+}
+
+func (d *Diskv) indexDir() string {
+	return filepath.Join(d.BasePath, metaDir, "index")
+}
+
+// secondaryFresh reports whether the journal loaded into si still matches
+// the store. Changes made while a persisted index is not registered are
+// counted in the store's change counter, and each journal notes the count
+// it is up to date with: if the two differ, the store has changed since.
+func (d *Diskv) secondaryFresh(si *secondaryIndex) (bool, error) {
+	n, err := d.changeCount()
+	if err != nil {
+		return false, err
+	}
+	si.RLock()
+	defer si.RUnlock()
+	return si.changes == n, nil
+}
+
+// changeCount returns the store's change counter, zero if none was kept.
+func (d *Diskv) changeCount() (uint64, error) {
+	b, err := readFile(d.FileSystem, filepath.Join(d.indexDir(), changesName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, errCorruptChanges
+	}
+	return n, nil
+}
+
+// changedWithLock is called after every change made to the store. Registered
+// indexes keep themselves up to date; if some persisted index is not
+// registered, the change counter is bumped so that it will be found stale,
+// and the registered ones note the new count in their journals.
+func (d *Diskv) changedWithLock() error {
+	if d.journals == nil {
+		entries, err := d.FileSystem.ReadDir(d.indexDir())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.journals = map[string]bool{}
+		for _, e := range entries {
+			if name, ok := strings.CutSuffix(e.Name(), ".journal"); ok && e.Type().IsRegular() {
+				d.journals[name] = true
+			}
+		}
+	}
+
+	unregistered := false
+	for name := range d.journals {
+		if _, ok := d.secondary[name]; !ok {
+			unregistered = true
+			break
+		}
+	}
+	if !unregistered {
+		return nil
+	}
+
+	n, err := d.changeCount()
+	if err != nil {
+		return err
+	}
+	n++
+	err = writeFileAtomic(d.FileSystem, filepath.Join(d.indexDir(), changesName), d.PathPerm, d.FilePerm, func(f io.Writer) error {
+		_, err := fmt.Fprintf(f, "%d\n", n)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("change counter: %s", err)
+	}
+	for name, si := range d.secondary {
+		if err := si.mark(n); err != nil {
+			return fmt.Errorf("secondary index %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (d *Diskv) buildSecondaryWithLock(si *secondaryIndex) error {
+	n, err := d.changeCount()
+	if err != nil {
+		return err
+	}
+	si.changes = n
+	for key, err := range d.walkKeys("") {
+		if err != nil {
+			return err
+		}
+		rc, err := d.readValue(d.transform(key), d.compressionFor(key), nil)
+		if err != nil {
+			return err
+		}
+		val, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		si.update(key, val)
+	}
+	if d.ReadOnly {
+		return nil // kept in memory only
+	}
+	return si.compact()
+}
+
+func (d *Diskv) updateSecondaryWithLock(key string, val []byte) error {
+	if err := d.changedWithLock(); err != nil {
+		return err
+	}
+	for name, si := range d.secondary {
+		if err := si.persist(si.update(key, val)); err != nil {
+			return fmt.Errorf("secondary index %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (d *Diskv) removeSecondaryWithLock(key string) error {
+	if err := d.changedWithLock(); err != nil {
+		return err
+	}
+	for name, si := range d.secondary {
+		if err := si.persist(si.remove(key)); err != nil {
+			return fmt.Errorf("secondary index %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+type journalOp struct {
+	add       bool
+	term, key string
+}
+
+func (si *secondaryIndex) update(key string, val []byte) []journalOp {
+	terms := dedupTerms(si.extract(key, val))
+
+	si.Lock()
+	defer si.Unlock()
+
+	ops := []journalOp{}
+	old := si.byKey[key]
+	for _, term := range old {
+		if !containsTerm(terms, term) {
+			ops = append(ops, journalOp{add: false, term: term, key: key})
+		}
+	}
+	for _, term := range terms {
+		if !containsTerm(old, term) {
+			ops = append(ops, journalOp{add: true, term: term, key: key})
+		}
+	}
+	si.applyWithLock(ops)
+	return ops
+}
+
+func (si *secondaryIndex) remove(key string) []journalOp {
+	si.Lock()
+	defer si.Unlock()
+
+	ops := []journalOp{}
+	for _, term := range si.byKey[key] {
+		ops = append(ops, journalOp{add: false, term: term, key: key})
+	}
+	si.applyWithLock(ops)
+	return ops
+}
+
+func (si *secondaryIndex) applyWithLock(ops []journalOp) {
+	for _, op := range ops {
+		var item *termItem
+		if got := si.terms.Get(&termItem{term: op.term}); got != nil {
+			item = got.(*termItem)
+		}
+
+		if op.add {
+			if item == nil {
+				item = &termItem{term: op.term, keys: map[string]struct{}{}}
+				si.terms.ReplaceOrInsert(item)
+			}
+			if _, ok := item.keys[op.key]; !ok {
+				item.keys[op.key] = struct{}{}
+				si.byKey[op.key] = append(si.byKey[op.key], op.term)
+				si.entries++
+			}
+			continue
+		}
+
+		if item == nil {
+			continue
+		}
+		if _, ok := item.keys[op.key]; !ok {
+			continue
+		}
+		delete(item.keys, op.key)
+		if len(item.keys) == 0 {
+			si.terms.Delete(item)
+		}
+		terms := si.byKey[op.key][:0]
+		for _, term := range si.byKey[op.key] {
+			if term != op.term {
+				terms = append(terms, term)
+			}
+		}
+		if len(terms) == 0 {
+			delete(si.byKey, op.key)
+		} else {
+			si.byKey[op.key] = terms
+		}
+		si.entries--
+	}
+}
+
+func (si *secondaryIndex) lookup(from, to string) []string {
+	si.RLock()
+	defer si.RUnlock()
+
+	seen := map[string]struct{}{}
+	iterator := func(i btree.Item) bool {
+		for key := range i.(*termItem).keys {
+			seen[key] = struct{}{}
+		}
+		return true
+	}
+	if to == "" {
+		si.terms.AscendGreaterOrEqual(&termItem{term: from}, iterator)
+	} else {
+		si.terms.AscendRange(&termItem{term: from}, &termItem{term: to}, iterator)
+	}
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (si *secondaryIndex) reset() {
+	si.Lock()
+	defer si.Unlock()
+	si.terms = btree.New(2)
+	si.byKey = map[string][]string{}
+	si.entries, si.ops, si.changes = 0, 0, 0
+}
+
+func (si *secondaryIndex) persist(ops []journalOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	si.Lock()
+	si.ops += len(ops)
+	needCompact := si.ops > 2*si.entries+1024
+	si.Unlock()
+	if needCompact {
+		return si.compact()
+	}
+
+	return si.append(func(w io.Writer) error {
+		return writeJournal(w, ops)
+	})
+}
+
+// mark notes in the journal that the index is up to date with change
+// count n.
+func (si *secondaryIndex) mark(n uint64) error {
+	si.Lock()
+	si.changes = n
+	si.Unlock()
+	return si.append(func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "= %d\n", n)
+		return err
+	})
+}
+
+func (si *secondaryIndex) append(fill func(w io.Writer) error) error {
+	if err := si.fs.MkdirAll(filepath.Dir(si.path), si.pathPerm); err != nil {
+		return err
+	}
+	f, err := si.fs.OpenFile(si.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, si.filePerm)
+	if err != nil {
+		return err
+	}
+	if err := fill(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (si *secondaryIndex) compact() error {
+	si.Lock()
+	defer si.Unlock()
+
+	ops := []journalOp{}
+	si.terms.Ascend(func(i btree.Item) bool {
+		item := i.(*termItem)
+		keys := make([]string, 0, len(item.keys))
+		for key := range item.keys {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ops = append(ops, journalOp{add: true, term: item.term, key: key})
+		}
+		return true
+	})
+
+	err := writeFileAtomic(si.fs, si.path, si.pathPerm, si.filePerm, func(f io.Writer) error {
+		if si.changes > 0 {
+			if _, err := fmt.Fprintf(f, "= %d\n", si.changes); err != nil {
+				return err
+			}
+		}
+		return writeJournal(f, ops)
+	})
+	if err != nil {
+		return err
+	}
+	si.ops = len(ops)
+	return nil
+}
+
+func (si *secondaryIndex) load() error {
+	f, err := openFile(si.fs, si.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	si.Lock()
+	defer si.Unlock()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		if n, ok := strings.CutPrefix(scanner.Text(), "= "); ok {
+			if si.changes, err = strconv.ParseUint(n, 10, 64); err != nil {
+				return errCorruptJournal
+			}
+			continue
+		}
+		op, err := parseJournalOp(scanner.Text())
+		if err != nil {
+			return err
+		}
+		si.applyWithLock([]journalOp{op})
+		si.ops++
+	}
+	return scanner.Err()
+}
+
+func writeJournal(w io.Writer, ops []journalOp) error {
+	bw := bufio.NewWriter(w)
+	for _, op := range ops {
+		sign := '-'
+		if op.add {
+			sign = '+'
+		}
+		fmt.Fprintf(bw, "%c %s %s\n", sign, strconv.Quote(op.term), strconv.Quote(op.key))
+	}
+	return bw.Flush()
+}
+
+func parseJournalOp(line string) (journalOp, error) {
+	if len(line) < 2 || (line[0] != '+' && line[0] != '-') || line[1] != ' ' {
+		return journalOp{}, errCorruptJournal
+	}
+	op := journalOp{add: line[0] == '+'}
+	rest := line[2:]
+
+	quoted, err := strconv.QuotedPrefix(rest)
+	if err != nil {
+		return journalOp{}, errCorruptJournal
+	}
+	op.term, _ = strconv.Unquote(quoted)
+	rest = strings.TrimPrefix(rest[len(quoted):], " ")
+
+	if op.key, err = strconv.Unquote(rest); err != nil {
+		return journalOp{}, errCorruptJournal
+	}
+	return op, nil
+}
+
+func dedupTerms(terms []string) []string {
+	out := []string{}
+	for _, term := range terms {
+		if !containsTerm(out, term) {
+			out = append(out, term)
+		}
+	}
+	return out
+}
+
+func containsTerm(terms []string, term string) bool {
+	for _, t := range terms {
+		if t == term {
+			return true
+		}
+	}
+	return false
+}
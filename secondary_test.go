@@ -0,0 +1,231 @@
+package studydiskv
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ownerExtractor(key string, val []byte) []string {
+	var doc struct {
+		Owner string `json:"owner"`
+	}
+	if err := json.Unmarshal(val, &doc); err != nil || doc.Owner == "" {
+		return nil
+	}
+	return []string{doc.Owner}
+}
+
+func TestSecondaryLookup(t *testing.T) {
+	d := New(Options{
+		BasePath: "test-secondary",
+	})
+	defer d.EraseAll()
+
+	if err := d.RegisterSecondaryIndex("owner", ownerExtractor); err != nil {
+		t.Fatal(err)
+	}
+
+	d.WriteString("a", `{"owner":"alice"}`)
+	d.WriteString("b", `{"owner":"bob"}`)
+	d.WriteString("c", `{"owner":"alice"}`)
+	d.WriteString("d", `not json`)
+
+	if have, err := d.Lookup("owner", "alice"); err != nil {
+		t.Fatal(err)
+	} else if want := []string{"a", "c"}; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	d.WriteString("c", `{"owner":"carol"}`)
+	d.Erase("b")
+
+	if have, _ := d.Lookup("owner", "alice"); !reflect.DeepEqual([]string{"a"}, have) {
+		t.Errorf("after rewrite: want [a], have %v", have)
+	}
+	if have, _ := d.Lookup("owner", "bob"); len(have) != 0 {
+		t.Errorf("after erase: want no keys, have %v", have)
+	}
+	if have, _ := d.LookupRange("owner", "b", ""); !reflect.DeepEqual([]string{"c"}, have) {
+		t.Errorf("range: want [c], have %v", have)
+	}
+	if have, _ := d.LookupRange("owner", "a", "c"); !reflect.DeepEqual([]string{"a"}, have) {
+		t.Errorf("bounded range: want [a], have %v", have)
+	}
+
+	if _, err := d.Lookup("nope", "x"); err != errNoSuchIndex {
+		t.Errorf("want errNoSuchIndex, have %v", err)
+	}
+}
+
+func TestSecondaryPersistence(t *testing.T) {
+	d1 := New(Options{
+		BasePath: "test-secondary",
+	})
+	defer d1.EraseAll()
+
+	d1.WriteString("before", `{"owner":"alice"}`)
+	if err := d1.RegisterSecondaryIndex("owner", ownerExtractor); err != nil {
+		t.Fatal(err)
+	}
+	d1.WriteString("after", `{"owner":"alice"}`)
+	d1.WriteString("gone", `{"owner":"alice"}`)
+	d1.Erase("gone")
+
+	for key := range d1.Keys(nil) {
+		if key == "gone" || (key != "before" && key != "after") {
+			t.Errorf("unexpected key %q", key)
+		}
+	}
+
+	d2 := New(Options{
+		BasePath: "test-secondary",
+	})
+	if err := d2.RegisterSecondaryIndex("owner", ownerExtractor); err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := d2.Lookup("owner", "alice"); !reflect.DeepEqual([]string{"after", "before"}, have) {
+		t.Errorf("want [after before], have %v", have)
+	}
+}
+
+func TestSecondaryReservedKey(t *testing.T) {
+	d := New(Options{
+		BasePath: "test-secondary",
+	})
+	defer d.EraseAll()
+
+	if err := d.WriteString(metaDir, "x"); err != errBadKey {
+		t.Errorf("want errBadKey, have %v", err)
+	}
+}
+
+func TestSecondaryPermissions(t *testing.T) {
+	d := New(Options{
+		BasePath: "test-secondary-perm",
+		PathPerm: 0750,
+		FilePerm: 0640,
+	})
+	defer d.EraseAll()
+
+	d.WriteString("a", `{"owner":"alice"}`)
+	if err := d.RegisterSecondaryIndex("owner", ownerExtractor); err != nil {
+		t.Fatal(err)
+	}
+	d.WriteString("b", `{"owner":"bob"}`)
+
+	journal := filepath.Join(d.BasePath, metaDir, "index", "owner.journal")
+	for path, want := range map[string]os.FileMode{filepath.Dir(journal): 0750, journal: 0640} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := fi.Mode().Perm(); have != want {
+			t.Errorf("%s: want %v, have %v", path, want, have)
+		}
+	}
+}
+
+func TestSecondaryStale(t *testing.T) {
+	d1 := New(Options{
+		BasePath: "test-secondary-stale",
+	})
+	defer d1.EraseAll()
+
+	if err := d1.RegisterSecondaryIndex("owner", ownerExtractor); err != nil {
+		t.Fatal(err)
+	}
+	d1.WriteString("a", `{"owner":"alice"}`)
+	d1.WriteString("b", `{"owner":"alice"}`)
+	d1.WriteString("plain", `not json`)
+
+	if fresh, err := d1.secondaryFresh(d1.secondary["owner"]); err != nil || !fresh {
+		t.Fatalf("journal kept up to date found stale: %v", err)
+	}
+
+	// Another writer, without the index, changes the store.
+	time.Sleep(10 * time.Millisecond)
+	d2 := New(Options{
+		BasePath: "test-secondary-stale",
+	})
+	d2.WriteString("c", `{"owner":"carol"}`)
+	d2.Erase("b")
+
+	d3 := New(Options{
+		BasePath: "test-secondary-stale",
+	})
+	if err := d3.RegisterSecondaryIndex("owner", ownerExtractor); err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := d3.Lookup("owner", "alice"); !reflect.DeepEqual([]string{"a"}, have) {
+		t.Errorf("alice: want [a], have %v", have)
+	}
+	if have, _ := d3.Lookup("owner", "carol"); !reflect.DeepEqual([]string{"c"}, have) {
+		t.Errorf("carol: want [c], have %v", have)
+	}
+}
+
+func TestSecondaryStaleOldModTime(t *testing.T) {
+	src := New(Options{
+		BasePath: "test-secondary-sync-src",
+	})
+	defer src.EraseAll()
+	d1 := New(Options{
+		BasePath: "test-secondary-sync-dst",
+	})
+	defer d1.EraseAll()
+
+	if err := d1.RegisterSecondaryIndex("owner", ownerExtractor); err != nil {
+		t.Fatal(err)
+	}
+	d1.WriteString("a", `{"owner":"alice"}`)
+	if _, err := os.Stat(filepath.Join(d1.indexDir(), changesName)); !os.IsNotExist(err) {
+		t.Errorf("change counter kept with every index registered: %v", err)
+	}
+
+	// Sync, made without the index, carries over the source's older
+	// modification time.
+	src.WriteString("a", `{"owner":"alice"}`)
+	src.WriteString("c", `{"owner":"carol"}`)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(src.completeFilename(src.transform("c")), old, old)
+	d2 := New(Options{
+		BasePath: "test-secondary-sync-dst",
+	})
+	report, err := Sync(context.Background(), src, d2, CompareSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{"c"}, report.Added) || len(report.Changed)+len(report.Removed) > 0 {
+		t.Fatalf("want only c added, have %+v", report)
+	}
+
+	d3 := New(Options{
+		BasePath: "test-secondary-sync-dst",
+	})
+	if err := d3.RegisterSecondaryIndex("owner", ownerExtractor); err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := d3.Lookup("owner", "carol"); !reflect.DeepEqual([]string{"c"}, have) {
+		t.Errorf("carol: want [c], have %v", have)
+	}
+
+	// The journal d3 rebuilt and kept up to date is fresh.
+	d3.WriteString("d", `{"owner":"dave"}`)
+	d4 := New(Options{
+		BasePath: "test-secondary-sync-dst",
+	})
+	if err := d4.RegisterSecondaryIndex("owner", ownerExtractor); err != nil {
+		t.Fatal(err)
+	}
+	if fresh, err := d4.secondaryFresh(d4.secondary["owner"]); err != nil || !fresh {
+		t.Errorf("journal kept up to date found stale: %v", err)
+	}
+	if have, _ := d4.Lookup("owner", "dave"); !reflect.DeepEqual([]string{"d"}, have) {
+		t.Errorf("dave: want [d], have %v", have)
+	}
+}
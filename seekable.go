@@ -0,0 +1,283 @@
+package studydiskv
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// The seekable format compresses fixed-size chunks independently:
+//
+//	chunk*     uint32 compressed length, flate data
+//	0          uint32
+//	index      uint32 compressed length of each chunk
+//	trailer    uint32 chunk size, uint64 total size, uint32 chunks, magic
+//
+// Streaming readers decode the chunks in turn; random access reads the
+// trailer and index and decodes only the chunks a range touches.
+
+const (
+	defaultSeekableChunkSize = 64 << 10
+	seekableTrailerMagic     = "dkvS"
+	seekableTrailerSize      = 4 + 8 + 4 + len(seekableTrailerMagic)
+)
+
+var errSeekableCorrupt = errors.New("seekable: corrupt input")
+
+// NewSeekableCompression compresses values in independent chunks of
+// chunkSize bytes, so that ranges of them can be read without decompressing
+// what precedes them.
+func NewSeekableCompression(chunkSize int) Codec {
+	if chunkSize <= 0 {
+		chunkSize = defaultSeekableChunkSize
+	}
+	return &codec{
+		id: seekableCodecID,
+		genericCompression: genericCompression{
+			wf: func(w io.Writer) (io.WriteCloser, error) {
+				return &seekableWriter{w: w, chunkSize: chunkSize}, nil
+			},
+			rf: func(r io.Reader) (io.ReadCloser, error) {
+				return &seekableReader{r: r}, nil
+			},
+		},
+	}
+}
+
+type seekableWriter struct {
+	w         io.Writer
+	chunkSize int
+	buf       []byte
+	lens      []uint32
+	total     uint64
+	err       error
+}
+
+func (w *seekableWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		take := w.chunkSize - len(w.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+		if len(w.buf) == w.chunkSize {
+			if w.err = w.flush(); w.err != nil {
+				return 0, w.err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *seekableWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var chunk bytes.Buffer
+	chunk.Write([]byte{0, 0, 0, 0})
+	fw, _ := flate.NewWriter(&chunk, flate.DefaultCompression)
+	fw.Write(w.buf)
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	b := chunk.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	if _, err := w.w.Write(b); err != nil {
+		return err
+	}
+	w.lens = append(w.lens, uint32(len(b)-4))
+	w.total += uint64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *seekableWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.err = w.flush(); w.err != nil {
+		return w.err
+	}
+
+	tail := make([]byte, 4+4*len(w.lens)+seekableTrailerSize)
+	p := tail[4:]
+	for _, l := range w.lens {
+		binary.BigEndian.PutUint32(p, l)
+		p = p[4:]
+	}
+	binary.BigEndian.PutUint32(p, uint32(w.chunkSize))
+	binary.BigEndian.PutUint64(p[4:], w.total)
+	binary.BigEndian.PutUint32(p[12:], uint32(len(w.lens)))
+	copy(p[16:], seekableTrailerMagic)
+
+	_, w.err = w.w.Write(tail)
+	if w.err == nil {
+		w.err = errors.New("seekable: writer closed")
+		return nil
+	}
+	return w.err
+}
+
+type seekableReader struct {
+	r   io.Reader
+	buf []byte
+	err error
+}
+
+func (r *seekableReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.buf, r.err = r.nextChunk()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *seekableReader) nextChunk() ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r.r, l[:]); err != nil {
+		return nil, errSeekableCorrupt
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n == 0 {
+		// The index and trailer follow; only random access needs them.
+		io.Copy(ioutil.Discard, r.r)
+		return nil, io.EOF
+	}
+	return inflateChunk(io.LimitReader(r.r, int64(n)))
+}
+
+func (r *seekableReader) Close() error {
+	return nil
+}
+
+func inflateChunk(r io.Reader) ([]byte, error) {
+	fr := flate.NewReader(r)
+	defer fr.Close()
+	b, err := ioutil.ReadAll(fr)
+	if err != nil {
+		return nil, errSeekableCorrupt
+	}
+	return b, nil
+}
+
+// seekableValue reads ranges of a value stored in the seekable format,
+// starting at base within ra and ending at end.
+type seekableValue struct {
+	ra        io.ReaderAt
+	chunkSize int64
+	size      int64
+	offsets   []int64
+	lens      []uint32
+
+	mu        sync.Mutex // guards the cached chunk
+	cached    int
+	cachedBuf []byte
+}
+
+func newSeekableValue(ra io.ReaderAt, base, end int64) (*seekableValue, error) {
+	if end-base < int64(4+seekableTrailerSize) {
+		return nil, errSeekableCorrupt
+	}
+	trailer := make([]byte, seekableTrailerSize)
+	if _, err := ra.ReadAt(trailer, end-int64(seekableTrailerSize)); err != nil {
+		return nil, err
+	}
+	if string(trailer[16:]) != seekableTrailerMagic {
+		return nil, errSeekableCorrupt
+	}
+	v := &seekableValue{
+		ra:        ra,
+		chunkSize: int64(binary.BigEndian.Uint32(trailer)),
+		size:      int64(binary.BigEndian.Uint64(trailer[4:])),
+		cached:    -1,
+	}
+	n := int64(binary.BigEndian.Uint32(trailer[12:]))
+
+	indexStart := end - int64(seekableTrailerSize) - 4*n
+	if indexStart < base || v.chunkSize <= 0 {
+		return nil, errSeekableCorrupt
+	}
+	index := make([]byte, 4*n)
+	if _, err := ra.ReadAt(index, indexStart); err != nil {
+		return nil, err
+	}
+
+	off := base
+	for i := int64(0); i < n; i++ {
+		l := binary.BigEndian.Uint32(index[4*i:])
+		v.offsets = append(v.offsets, off+4)
+		v.lens = append(v.lens, l)
+		off += 4 + int64(l)
+	}
+	if off+4 != indexStart {
+		return nil, errSeekableCorrupt
+	}
+	return v, nil
+}
+
+func (v *seekableValue) Size() (int64, error) {
+	return v.size, nil
+}
+
+func (v *seekableValue) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	n := 0
+	for n < len(p) {
+		if off >= v.size {
+			return n, io.EOF
+		}
+		i := int(off / v.chunkSize)
+		if i >= len(v.offsets) {
+			return n, errSeekableCorrupt
+		}
+		b, err := v.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		within := off - int64(i)*v.chunkSize
+		if within >= int64(len(b)) {
+			return n, errSeekableCorrupt
+		}
+		c := copy(p[n:], b[within:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+// chunk returns chunk i decoded. The last chunk decoded is kept for the
+// next call; chunks are decoded outside the lock, so parallel ReadAt calls
+// do not wait on each other.
+func (v *seekableValue) chunk(i int) ([]byte, error) {
+	v.mu.Lock()
+	if v.cached == i {
+		b := v.cachedBuf
+		v.mu.Unlock()
+		return b, nil
+	}
+	v.mu.Unlock()
+
+	b, err := inflateChunk(io.NewSectionReader(v.ra, v.offsets[i], int64(v.lens[i])))
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	v.cached, v.cachedBuf = i, b
+	v.mu.Unlock()
+	return b, nil
+}
@@ -0,0 +1,293 @@
+package studydiskv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"iter"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// shardPoints is how many points each shard has on the hash ring when
+// NewSharded is given none. More points spread keys more evenly.
+const shardPoints = 128
+
+var errNoShards = errors.New("no shards")
+
+// Sharded spreads keys across several Diskvs, typically on different disks,
+// by consistent hashing: each shard owns the keys hashing onto its points
+// on a ring. Adding a shard moves only the keys its points take over.
+type Sharded struct {
+	points int
+
+	mu          sync.RWMutex // held exclusively while moving a key
+	shards      []*Diskv
+	ring        []ringPoint
+	rebalancing bool
+
+	rebalance sync.Mutex // held by Rebalance
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard *Diskv
+}
+
+var _ Store = (*Sharded)(nil)
+
+// NewSharded spreads keys across shards, each placed on the ring at points
+// points, or shardPoints if points is 0. A shard's place on the ring
+// depends only on its BasePath, so a Sharded made again from the same
+// shards, in any order, puts every key where it was.
+func NewSharded(shards []*Diskv, points int) (*Sharded, error) {
+	if len(shards) == 0 {
+		return nil, errNoShards
+	}
+	if points <= 0 {
+		points = shardPoints
+	}
+	s := &Sharded{points: points}
+	for _, d := range shards {
+		if err := s.checkShard(d); err != nil {
+			return nil, err
+		}
+		s.shards = append(s.shards, d)
+	}
+	s.ring = s.buildRing(s.shards)
+	return s, nil
+}
+
+func (s *Sharded) checkShard(d *Diskv) error {
+	for _, other := range s.shards {
+		if other == d || other.BasePath == d.BasePath {
+			return fmt.Errorf("shard %s used twice", d.BasePath)
+		}
+	}
+	return nil
+}
+
+func (s *Sharded) buildRing(shards []*Diskv) []ringPoint {
+	ring := make([]ringPoint, 0, len(shards)*s.points)
+	for _, d := range shards {
+		for i := 0; i < s.points; i++ {
+			ring = append(ring, ringPoint{hashKey(d.BasePath + "#" + strconv.Itoa(i)), d})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].shard.BasePath < ring[j].shard.BasePath
+	})
+	return ring
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	return h.Sum64()
+}
+
+// Shards returns the shards, in the order they were added.
+func (s *Sharded) Shards() []*Diskv {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*Diskv(nil), s.shards...)
+}
+
+// ShardFor returns the shard owning key.
+func (s *Sharded) ShardFor(key string) *Diskv {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ownerWithLock(key)
+}
+
+func (s *Sharded) ownerWithLock(key string) *Diskv {
+	h := hashKey(key)
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].shard
+}
+
+// findWithLock returns the shard holding key: its owner, or while keys are
+// being rebalanced, whichever shard still has it.
+func (s *Sharded) findWithLock(key string) *Diskv {
+	owner := s.ownerWithLock(key)
+	if !s.rebalancing || owner.Has(key) {
+		return owner
+	}
+	for _, d := range s.shards {
+		if d != owner && d.Has(key) {
+			return d
+		}
+	}
+	return owner
+}
+
+func (s *Sharded) Read(key string) ([]byte, error) {
+	rc, err := s.ReadStream(key, false)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (s *Sharded) ReadStream(key string, direct bool) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.findWithLock(key).ReadStream(key, direct)
+}
+
+func (s *Sharded) Write(key string, val []byte) error {
+	return s.WriteStream(key, bytes.NewReader(val), false)
+}
+
+// WriteStream writes key to its owner. While keys are being rebalanced it
+// also erases any copy of key left on another shard.
+func (s *Sharded) WriteStream(key string, r io.Reader, sync bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	owner := s.ownerWithLock(key)
+	if err := owner.WriteStream(key, r, sync); err != nil {
+		return err
+	}
+	if !s.rebalancing {
+		return nil
+	}
+	for _, d := range s.shards {
+		if d == owner {
+			continue
+		}
+		if err := d.Erase(key); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sharded) Erase(key string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.rebalancing {
+		return s.ownerWithLock(key).Erase(key)
+	}
+	found := false
+	for _, d := range s.shards {
+		err := d.Erase(key)
+		if err == nil {
+			found = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !found {
+		return &os.PathError{Op: "erase", Path: key, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (s *Sharded) Has(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.findWithLock(key).Has(key)
+}
+
+func (s *Sharded) Keys(cancel <-chan struct{}) <-chan string {
+	return s.KeysPrefix("", cancel)
+}
+
+func (s *Sharded) KeysPrefix(prefix string, cancel <-chan struct{}) <-chan string {
+	return keysChan(s.KeysSeq(prefix), cancel)
+}
+
+// KeysSeq yields every key beginning with prefix, from all shards, in
+// lexical order.
+func (s *Sharded) KeysSeq(prefix string) iter.Seq2[string, error] {
+	shards := s.Shards()
+	seqs := make([]iter.Seq2[string, error], len(shards))
+	for i, d := range shards {
+		seqs[i] = d.walkKeys(prefix)
+	}
+	return mergeKeys(seqs)
+}
+
+// AddShard adds d to the ring, then rebalances, moving to d the keys it
+// now owns. Keys stay readable and writable throughout. If rebalancing
+// fails or ctx is cancelled, the keys not yet moved stay readable, and
+// Rebalance may be called to finish.
+func (s *Sharded) AddShard(ctx context.Context, d *Diskv) error {
+	s.rebalance.Lock()
+	s.mu.Lock()
+	if err := s.checkShard(d); err != nil {
+		s.mu.Unlock()
+		s.rebalance.Unlock()
+		return err
+	}
+	s.shards = append(s.shards, d)
+	s.ring = s.buildRing(s.shards)
+	s.rebalancing = true
+	s.mu.Unlock()
+	s.rebalance.Unlock()
+
+	return s.Rebalance(ctx)
+}
+
+// Rebalance moves every key not on its owner to its owner. Call it after
+// making a Sharded from shards other than those the keys were written
+// with.
+func (s *Sharded) Rebalance(ctx context.Context) error {
+	s.rebalance.Lock()
+	defer s.rebalance.Unlock()
+
+	s.mu.Lock()
+	s.rebalancing = true
+	s.mu.Unlock()
+
+	for _, d := range s.Shards() {
+		for key, err := range d.walkKeys("") {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := s.moveKey(key, d); err != nil {
+				return fmt.Errorf("move %s: %s", key, err)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.rebalancing = false
+	s.mu.Unlock()
+	return nil
+}
+
+// moveKey moves key from d to its owner, if d is not its owner. A copy on
+// d is dropped if the owner has been given key since rebalancing began.
+func (s *Sharded) moveKey(key string, d *Diskv) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owner := s.ownerWithLock(key)
+	if owner == d {
+		return nil
+	}
+	if !owner.Has(key) {
+		if ok, err := copyValue(d, owner, key); !ok || err != nil {
+			return err
+		}
+	}
+	if err := d.Erase(key); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package studydiskv
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func newTestShards(t *testing.T, n int) []*Diskv {
+	shards := make([]*Diskv, n)
+	for i := range shards {
+		shards[i] = New(Options{BasePath: fmt.Sprintf("test-shard-%d", i)})
+		t.Cleanup(func() { shards[i].EraseAll() })
+	}
+	return shards
+}
+
+func TestSharded(t *testing.T) {
+	shards := newTestShards(t, 4)
+	s, err := NewSharded(shards[:3], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		if err := s.Write(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, key)
+	}
+	for _, d := range shards[:3] {
+		if n := len(collectKeys(t, d, "")); n < 50 {
+			t.Errorf("%s: only %d keys", d.BasePath, n)
+		}
+	}
+	if keys := collectKeys(t, s, ""); !cmpStrings(keys, want) {
+		t.Errorf("keys: want %v, have %v", want, keys)
+	}
+	if keys := collectKeys(t, s, "k29"); !cmpStrings(keys, want[290:]) {
+		t.Errorf("keys with prefix: have %v", keys)
+	}
+
+	// Reopened with the shards in another order, keys stay put.
+	reopened, err := NewSharded([]*Diskv{shards[2], shards[0], shards[1]}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range want {
+		if a, b := s.ShardFor(key), reopened.ShardFor(key); a != b {
+			t.Fatalf("%s: on %s, reopened on %s", key, a.BasePath, b.BasePath)
+		}
+	}
+
+	owners := map[string]*Diskv{}
+	for _, key := range want {
+		owners[key] = s.ShardFor(key)
+	}
+	if err := s.AddShard(context.Background(), shards[3]); err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	for _, key := range want {
+		owner := s.ShardFor(key)
+		if owner != owners[key] {
+			moved++
+			if owner != shards[3] {
+				t.Errorf("%s: moved between old shards", key)
+			}
+		}
+		if !owner.Has(key) {
+			t.Errorf("%s: not on its shard", key)
+		}
+		if val, err := s.Read(key); err != nil || string(val) != key {
+			t.Errorf("%s: have %q, %v", key, val, err)
+		}
+	}
+	if moved == 0 || moved > len(want)/2 {
+		t.Errorf("%d of %d keys moved", moved, len(want))
+	}
+	total := 0
+	for _, d := range shards {
+		total += len(collectKeys(t, d, ""))
+	}
+	if total != len(want) {
+		t.Errorf("%d copies of %d keys", total, len(want))
+	}
+
+	if err := s.Erase("k000"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has("k000") {
+		t.Errorf("k000 left after erase")
+	}
+
+	if _, err := NewSharded(nil, 0); err != errNoShards {
+		t.Errorf("want %v, have %v", errNoShards, err)
+	}
+	if err := s.AddShard(context.Background(), shards[0]); err == nil {
+		t.Errorf("shard added twice")
+	}
+}
+
+func TestShardedRebalanceOnline(t *testing.T) {
+	shards := newTestShards(t, 3)
+	s, err := NewSharded(shards[:2], 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		s.Write(fmt.Sprintf("k%03d", i), []byte("old"))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i += 2 {
+			key := fmt.Sprintf("k%03d", i)
+			if err := s.Write(key, []byte("new")); err != nil {
+				t.Error(err)
+			}
+			if val, err := s.Read(fmt.Sprintf("k%03d", i+1)); err != nil || string(val) != "old" {
+				t.Errorf("read during rebalance: have %q, %v", val, err)
+			}
+		}
+	}()
+	if err := s.AddShard(context.Background(), shards[2]); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	keys := collectKeys(t, s, "")
+	if len(keys) != 200 || !sort.StringsAreSorted(keys) {
+		t.Fatalf("have %d keys: %v", len(keys), keys)
+	}
+	for i, key := range keys {
+		want := []string{"new", "old"}[i%2]
+		if val, err := s.Read(key); err != nil || string(val) != want {
+			t.Errorf("%s: want %q, have %q, %v", key, want, val, err)
+		}
+		if !s.ShardFor(key).Has(key) {
+			t.Errorf("%s: not on its shard", key)
+		}
+	}
+
+	// Keys left on the wrong shard, as when a Sharded is made from other
+	// shards than the keys were written with, are put in place by Rebalance.
+	for i := 0; i < 200; i++ {
+		shards[0].WriteString(fmt.Sprintf("x%03d", i), "x")
+	}
+	if err := s.Rebalance(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("x%03d", i)
+		if !s.ShardFor(key).Has(key) {
+			t.Errorf("%s: not on its shard", key)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package studydiskv
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Snappy framing format, as described in the framing_format.txt of the
+// reference implementation, with a pure Go block encoder and decoder.
+
+const (
+	snappyMaxBlockSize = 65536
+	snappyStreamID     = "\xff\x06\x00\x00sNaPpY"
+
+	snappyChunkCompressed   = 0x00
+	snappyChunkUncompressed = 0x01
+	snappyChunkPadding      = 0xfe
+	snappyChunkStreamID     = 0xff
+)
+
+var (
+	errSnappyCorrupt = errors.New("snappy: corrupt input")
+	errSnappyCRC     = errors.New("snappy: checksum mismatch")
+	crc32c           = crc32.MakeTable(crc32.Castagnoli)
+)
+
+func NewSnappyCompression() Codec {
+	return &codec{
+		id:     snappyCodecID,
+		concat: true,
+		genericCompression: genericCompression{
+			wf: func(w io.Writer) (io.WriteCloser, error) {
+				return &snappyWriter{w: w}, nil
+			},
+			rf: func(r io.Reader) (io.ReadCloser, error) {
+				return &snappyReader{r: r}, nil
+			},
+		},
+	}
+}
+
+func snappyChecksum(b []byte) uint32 {
+	c := crc32.Checksum(b, crc32c)
+	return (c>>15 | c<<17) + 0xa282ead8
+}
+
+type snappyWriter struct {
+	w           io.Writer
+	buf         []byte
+	wroteStream bool
+	err         error
+}
+
+func (w *snappyWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		take := snappyMaxBlockSize - len(w.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+		if len(w.buf) == snappyMaxBlockSize {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *snappyWriter) flush() error {
+	if !w.wroteStream {
+		if _, err := io.WriteString(w.w, snappyStreamID); err != nil {
+			w.err = err
+			return err
+		}
+		w.wroteStream = true
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	chunkType, data := byte(snappyChunkCompressed), snappyEncode(nil, w.buf)
+	if len(data) >= len(w.buf)-len(w.buf)/8 {
+		chunkType, data = snappyChunkUncompressed, w.buf
+	}
+
+	var hdr [8]byte
+	chunkLen := len(data) + 4
+	hdr[0], hdr[1], hdr[2], hdr[3] = chunkType, byte(chunkLen), byte(chunkLen>>8), byte(chunkLen>>16)
+	binary.LittleEndian.PutUint32(hdr[4:], snappyChecksum(w.buf))
+	if _, err := w.w.Write(hdr[:]); err != nil {
+		w.err = err
+		return err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		w.err = err
+		return err
+	}
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *snappyWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	err := w.flush()
+	w.err = errors.New("snappy: writer closed")
+	return err
+}
+
+type snappyReader struct {
+	r   io.Reader
+	buf []byte
+	err error
+}
+
+func (r *snappyReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.nextChunk()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *snappyReader) nextChunk() error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return errSnappyCorrupt
+		}
+		return err
+	}
+	chunkType := hdr[0]
+	chunkLen := int(hdr[1]) | int(hdr[2])<<8 | int(hdr[3])<<16
+
+	data := make([]byte, chunkLen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return errSnappyCorrupt
+	}
+
+	switch {
+	case chunkType == snappyChunkStreamID:
+		if string(hdr[:])+string(data) != snappyStreamID {
+			return errSnappyCorrupt
+		}
+		return nil
+	case chunkType == snappyChunkCompressed, chunkType == snappyChunkUncompressed:
+		if chunkLen < 4 {
+			return errSnappyCorrupt
+		}
+		sum, payload := binary.LittleEndian.Uint32(data), data[4:]
+		if chunkType == snappyChunkCompressed {
+			var err error
+			if payload, err = snappyDecode(payload); err != nil {
+				return err
+			}
+		}
+		if len(payload) > snappyMaxBlockSize {
+			return errSnappyCorrupt
+		}
+		if snappyChecksum(payload) != sum {
+			return errSnappyCRC
+		}
+		r.buf = payload
+		return nil
+	case chunkType == snappyChunkPadding, chunkType >= 0x80:
+		return nil
+	}
+	return errSnappyCorrupt
+}
+
+func (r *snappyReader) Close() error {
+	return nil
+}
+
+func snappyEncode(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	if len(src) < 16 {
+		return snappyLiteral(dst, src)
+	}
+
+	const tableBits = 14
+	var table [1 << tableBits]int32
+	hash := func(u uint32) uint32 {
+		return (u * 0x1e35a7bd) >> (32 - tableBits)
+	}
+
+	nextEmit, s := 0, 1
+	for s <= len(src)-4 {
+		cur := binary.LittleEndian.Uint32(src[s:])
+		h := hash(cur)
+		cand := int(table[h])
+		table[h] = int32(s)
+
+		if cand >= s || s-cand > 65535 || binary.LittleEndian.Uint32(src[cand:]) != cur {
+			s += 1 + (s-nextEmit)>>5
+			continue
+		}
+
+		dst = snappyLiteral(dst, src[nextEmit:s])
+		length := 4
+		for s+length < len(src) && src[s+length] == src[cand+length] {
+			length++
+		}
+		dst = snappyCopy(dst, s-cand, length)
+		s += length
+		nextEmit = s
+	}
+	return snappyLiteral(dst, src[nextEmit:])
+}
+
+func snappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+}
+
+func snappyDecode(src []byte) ([]byte, error) {
+	n, l := binary.Uvarint(src)
+	if l <= 0 || n > snappyMaxBlockSize {
+		return nil, errSnappyCorrupt
+	}
+	dst := make([]byte, 0, n)
+
+	for s := l; s < len(src); {
+		var length, offset int
+		tag := src[s]
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			s++
+			if length >= 60 {
+				extra := length - 59
+				if s+extra > len(src) {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[s+i])
+				}
+				s += extra
+			}
+			length++
+			if length <= 0 || s+length > len(src) || len(dst)+length > int(n) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+		case 1:
+			if s+2 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[s+1])
+			s += 2
+		case 2:
+			if s+3 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case 3:
+			if s+5 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(n) {
+			return nil, errSnappyCorrupt
+		}
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+
+	if len(dst) != int(n) {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
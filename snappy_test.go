@@ -0,0 +1,68 @@
+package studydiskv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestSnappyRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("snappy snappy snap "), 10000)
+	noise := make([]byte, 200000)
+	rand.Read(noise)
+
+	for _, val := range [][]byte{{}, []byte("a"), []byte("short value"), text, noise, append(text[:70000:70000], noise...)} {
+		var buf bytes.Buffer
+		w, _ := NewSnappyCompression().Writer(&buf)
+		if _, err := w.Write(val); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, _ := NewSnappyCompression().Reader(&buf)
+		have, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("len %d: %s", len(val), err)
+		}
+		if !bytes.Equal(have, val) {
+			t.Fatalf("len %d: round trip differs", len(val))
+		}
+	}
+}
+
+func TestSnappyBlockFormat(t *testing.T) {
+	// A literal followed by copies, per the snappy format description.
+	src := []byte("abcdabcdabcdabcdabcdabcd")
+	enc := snappyEncode(nil, src)
+	if enc[0] != byte(len(src)) {
+		t.Fatalf("want length preamble %d, have %d", len(src), enc[0])
+	}
+	if len(enc) >= len(src) {
+		t.Errorf("repetitive input not compressed: %d >= %d", len(enc), len(src))
+	}
+
+	dec, err := snappyDecode([]byte{0x08, 0x0c, 'a', 'b', 'c', 'd', 0x01, 0x04})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec) != "abcdabcd" {
+		t.Errorf("want %q, have %q", "abcdabcd", dec)
+	}
+}
+
+func TestSnappyCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewSnappyCompression().Writer(&buf)
+	w.Write(bytes.Repeat([]byte("corrupt me "), 100))
+	w.Close()
+
+	b := buf.Bytes()
+	b[len(b)-1] ^= 0xff
+	r, _ := NewSnappyCompression().Reader(bytes.NewReader(b))
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Errorf("expected an error reading a corrupt stream")
+	}
+}
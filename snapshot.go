@@ -0,0 +1,326 @@
+package studydiskv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const manifestName = "manifest.json"
+
+// Manifest lists the values in a snapshot or backup, so that a later
+// Backup to the same directory can tell which ones changed.
+type Manifest struct {
+	Created time.Time
+	Entries map[string]ManifestEntry
+}
+
+type ManifestEntry struct {
+	Size    int64
+	ModTime time.Time
+}
+
+func (e ManifestEntry) matches(fi os.FileInfo) bool {
+	return e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime())
+}
+
+// ReadManifest reads the manifest Snapshot or Backup left in dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	return readManifest(NewOSFS(), dir)
+}
+
+func readManifest(fsys FS, dir string) (*Manifest, error) {
+	b, err := readFile(fsys, filepath.Join(dir, metaDir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("manifest: %s", err)
+	}
+	return m, nil
+}
+
+func (m *Manifest) write(fsys FS, dir string) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fsys, filepath.Join(dir, metaDir, manifestName), defaultPathPerm, defaultFilePerm, func(f io.Writer) error {
+		_, err := f.Write(b)
+		return err
+	})
+}
+
+// Snapshot makes dstDir, which must not hold any of the store's files yet,
+// a point-in-time copy of the store by hard linking every value's file into
+// it. Writes are held off only while each link is made: a write, erase or
+// rename of a key not yet linked first links the key's current file, so
+// the snapshot holds every value as it was when Snapshot was called, and
+// no key made since. Writes replace files rather than change them, so the
+// snapshot stays as it was. dstDir must be on the same filesystem as
+// BasePath, and can be opened with the same Options.
+func (d *Diskv) Snapshot(dstDir string) (*Manifest, error) {
+	s := &snapshot{
+		dir:   dstDir,
+		m:     &Manifest{Created: time.Now(), Entries: map[string]ManifestEntry{}},
+		taken: map[string]bool{},
+	}
+	d.mu.Lock()
+	d.snapshots = append(d.snapshots, s)
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		snapshots := d.snapshots[:0]
+		for _, other := range d.snapshots {
+			if other != s {
+				snapshots = append(snapshots, other)
+			}
+		}
+		d.snapshots = snapshots
+		d.mu.Unlock()
+	}()
+
+	for key, err := range d.walkKeys("") {
+		if err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+		s.takeWithLock(d, key)
+		err = s.err
+		d.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := d.mirrorDictionaries(dstDir, d.FileSystem.Link); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	if err := s.m.write(d.FileSystem, dstDir); err != nil {
+		return nil, err
+	}
+	return s.m, nil
+}
+
+// snapshot is a Snapshot being taken. Its fields are guarded by the
+// store's lock.
+type snapshot struct {
+	dir   string
+	m     *Manifest
+	taken map[string]bool // keys linked, or found made since
+	err   error
+}
+
+// takeWithLock links key's file into the snapshot, unless it has been
+// taken already. A key with no file has been made since the snapshot
+// began, or erased since it was taken, and is left out.
+func (s *snapshot) takeWithLock(d *Diskv, key string) {
+	if s.taken[key] || s.err != nil {
+		return
+	}
+	s.taken[key] = true
+
+	src := d.completeFilename(d.transform(key))
+	fi, err := d.FileSystem.Stat(src)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		dst := d.mirrorFilename(s.dir, key)
+		if err = d.FileSystem.MkdirAll(filepath.Dir(dst), d.PathPerm); err == nil {
+			err = d.FileSystem.Link(src, dst)
+		}
+	}
+	if err != nil {
+		s.err = fmt.Errorf("snapshot %s: %s", key, err)
+		return
+	}
+	s.m.Entries[key] = ManifestEntry{Size: fi.Size(), ModTime: fi.ModTime()}
+}
+
+// preserveWithLock is called before key's file is replaced or removed, to
+// keep it as it is in the snapshots being taken.
+func (d *Diskv) preserveWithLock(key string) {
+	for _, s := range d.snapshots {
+		s.takeWithLock(d, key)
+	}
+}
+
+// preserveAllWithLock is preserveWithLock for every key in the store.
+func (d *Diskv) preserveAllWithLock() {
+	if len(d.snapshots) == 0 {
+		return
+	}
+	for key, err := range d.walkKeys("") {
+		if err != nil {
+			for _, s := range d.snapshots {
+				if s.err == nil {
+					s.err = err
+				}
+			}
+			return
+		}
+		d.preserveWithLock(key)
+	}
+}
+
+// Backup brings dstDir up to date with the store, copying only the values
+// whose size or modification time differ from the manifest left there by
+// the previous Snapshot or Backup, and removing those since erased. Unlike
+// Snapshot it takes no lock, so it may be used across filesystems; each
+// value is copied as it was when opened.
+func (d *Diskv) Backup(ctx context.Context, dstDir string) (*Manifest, error) {
+	prev, err := readManifest(d.FileSystem, dstDir)
+	if os.IsNotExist(err) {
+		prev, err = &Manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{Created: time.Now(), Entries: map[string]ManifestEntry{}}
+	for key, err := range d.walkKeys("") {
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		src := d.completeFilename(d.transform(key))
+		fi, err := d.FileSystem.Stat(src)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := prev.Entries[key]; ok && e.matches(fi) {
+			m.Entries[key] = e
+			continue
+		}
+
+		e, err := d.backupFile(src, d.mirrorFilename(dstDir, key))
+		if os.IsNotExist(err) {
+			continue // erased since it was listed
+		}
+		if err != nil {
+			return nil, fmt.Errorf("backup %s: %s", key, err)
+		}
+		m.Entries[key] = e
+	}
+
+	for key := range prev.Entries {
+		if _, ok := m.Entries[key]; ok {
+			continue
+		}
+		dst := d.mirrorFilename(dstDir, key)
+		if err := d.FileSystem.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		pruneEmptyDirs(d.FileSystem, dstDir, filepath.Dir(dst))
+	}
+
+	if err := d.mirrorDictionaries(dstDir, d.copyFile); err != nil {
+		return nil, err
+	}
+	if err := m.write(d.FileSystem, dstDir); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (d *Diskv) backupFile(src, dst string) (ManifestEntry, error) {
+	f, err := openFile(d.FileSystem, src)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+
+	if err := d.FileSystem.MkdirAll(filepath.Dir(dst), d.PathPerm); err != nil {
+		return ManifestEntry{}, err
+	}
+	err = writeFileAtomic(d.FileSystem, dst, d.PathPerm, d.FilePerm, func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	if err := d.FileSystem.Chmod(dst, fi.Mode().Perm()); err != nil {
+		return ManifestEntry{}, err
+	}
+	if err := d.FileSystem.Chtimes(dst, fi.ModTime(), fi.ModTime()); err != nil {
+		return ManifestEntry{}, err
+	}
+	return ManifestEntry{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// mirrorFilename is where key's file goes in a copy of the store at dir.
+func (d *Diskv) mirrorFilename(dir, key string) string {
+	rel, _ := filepath.Rel(d.BasePath, d.completeFilename(d.transform(key)))
+	return filepath.Join(dir, rel)
+}
+
+// mirrorDictionaries puts the store's dictionaries, which values
+// compressed with them need, into the copy of the store at dir.
+func (d *Diskv) mirrorDictionaries(dir string, put func(src, dst string) error) error {
+	entries, err := d.FileSystem.ReadDir(d.dictionaryDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dstDir := filepath.Join(dir, metaDir, dictionaryPathPrefix)
+	for _, entry := range entries {
+		dst := filepath.Join(dstDir, entry.Name())
+		if _, err := d.FileSystem.Stat(dst); err == nil {
+			continue
+		}
+		if err := d.FileSystem.MkdirAll(dstDir, d.PathPerm); err != nil {
+			return err
+		}
+		if err := put(filepath.Join(d.dictionaryDir(), entry.Name()), dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Diskv) copyFile(src, dst string) error {
+	f, err := openFile(d.FileSystem, src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFileAtomic(d.FileSystem, dst, d.PathPerm, d.FilePerm, func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+}
+
+// pruneEmptyDirs removes dir and its parents up to, not including, root
+// for as long as they are empty.
+func pruneEmptyDirs(fsys FS, root, dir string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && len(dir) > len(root); dir = filepath.Dir(dir) {
+		if fsys.Remove(dir) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package studydiskv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	opts := Options{
+		BasePath:          "test-snapshot",
+		AdvancedTransform: hashTransform,
+		InverseTransform:  hashInverseTransform,
+		Compression:       NewSnappyCompression(),
+	}
+	d := New(opts)
+	defer d.EraseAll()
+	defer os.RemoveAll("test-snapshot-dst")
+
+	for _, k := range []string{"a", "b", "c"} {
+		if err := d.WriteString(k, "v"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := d.Snapshot("test-snapshot-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Entries) != 3 {
+		t.Errorf("manifest: want 3 entries, have %d", len(m.Entries))
+	}
+
+	d.WriteString("a", "changed")
+	d.Append("b", []byte("+"))
+	d.Erase("c")
+	d.WriteString("d", "new")
+
+	opts.BasePath = "test-snapshot-dst"
+	s := New(opts)
+	if keys := collectKeys(t, s, ""); !cmpStrings(keys, []string{"a", "b", "c"}) {
+		t.Errorf("snapshot keys: have %v", keys)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if have := s.ReadString(k); have != "v"+k {
+			t.Errorf("%s: want %q, have %q", k, "v"+k, have)
+		}
+	}
+}
+
+// pausingFS pauses the first Walk after it is armed once the walk is done,
+// until released.
+type pausingFS struct {
+	FS
+	armed   chan struct{}
+	walked  chan struct{}
+	release chan struct{}
+}
+
+func (f *pausingFS) Walk(root string, fn filepath.WalkFunc) error {
+	err := f.FS.Walk(root, fn)
+	select {
+	case <-f.armed:
+		close(f.walked)
+		<-f.release
+	default:
+	}
+	return err
+}
+
+func TestSnapshotConcurrentWrites(t *testing.T) {
+	mem := NewMemFS()
+	fsys := &pausingFS{FS: mem, armed: make(chan struct{}, 1), walked: make(chan struct{}), release: make(chan struct{})}
+	opts := Options{
+		BasePath:   "test-snapshot",
+		FileSystem: fsys,
+	}
+	d := New(opts)
+	for _, k := range []string{"a", "b", "c", "e"} {
+		if err := d.WriteString(k, "v"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The writes below run while Snapshot is between listing the keys and
+	// linking them; they must neither wait for it nor show in it.
+	fsys.armed <- struct{}{}
+	done := make(chan error)
+	var m *Manifest
+	go func() {
+		var err error
+		m, err = d.Snapshot("test-snapshot-dst")
+		done <- err
+	}()
+	<-fsys.walked
+	d.WriteString("a", "changed")
+	d.Erase("b")
+	d.Append("c", []byte("+"))
+	d.WriteString("d", "new")
+	d.Rename("e", "f")
+	close(fsys.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a", "b", "c", "e"}
+	if len(m.Entries) != len(want) {
+		t.Errorf("manifest: want %d entries, have %d", len(want), len(m.Entries))
+	}
+	opts.BasePath, opts.FileSystem = "test-snapshot-dst", mem
+	s := New(opts)
+	if keys := collectKeys(t, s, ""); !cmpStrings(keys, want) {
+		t.Errorf("snapshot keys: want %v, have %v", want, keys)
+	}
+	for _, k := range want {
+		if have := s.ReadString(k); have != "v"+k {
+			t.Errorf("%s: want %q, have %q", k, "v"+k, have)
+		}
+	}
+	if have := d.ReadString("c"); have != "vc+" {
+		t.Errorf("store: c: want %q, have %q", "vc+", have)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	opts := Options{
+		BasePath:          "test-backup",
+		AdvancedTransform: hashTransform,
+		InverseTransform:  hashInverseTransform,
+	}
+	d := New(opts)
+	defer d.EraseAll()
+	defer os.RemoveAll("test-backup-dst")
+
+	for _, k := range []string{"a", "b", "c"} {
+		if err := d.WriteString(k, "v"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Backup(context.Background(), "test-backup-dst"); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := New(Options{
+		BasePath:          "test-backup-dst",
+		AdvancedTransform: hashTransform,
+		InverseTransform:  hashInverseTransform,
+	})
+	before, err := os.Stat(dst.completeFilename(dst.transform("b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.WriteString("a", "changed")
+	d.Erase("c")
+	d.WriteString("d", "new")
+	m, err := d.Backup(context.Background(), "test-backup-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Entries) != 3 {
+		t.Errorf("manifest: want 3 entries, have %d", len(m.Entries))
+	}
+
+	after, err := os.Stat(dst.completeFilename(dst.transform("b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Errorf("unchanged value copied again")
+	}
+	if keys := collectKeys(t, dst, ""); !cmpStrings(keys, []string{"a", "b", "d"}) {
+		t.Errorf("backup keys: have %v", keys)
+	}
+	for k, want := range map[string]string{"a": "changed", "b": "vb", "d": "new"} {
+		if have := dst.ReadString(k); have != want {
+			t.Errorf("%s: want %q, have %q", k, want, have)
+		}
+	}
+}
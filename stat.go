@@ -0,0 +1,84 @@
+package studydiskv
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// ValueInfo describes a stored value.
+type ValueInfo struct {
+	Key        string
+	Path       string
+	Codec      string
+	StoredSize int64
+	Size       int64
+	ModTime    time.Time
+}
+
+var codecNames = map[byte]string{
+	rawCodecID:      "raw",
+	gzipCodecID:     "gzip",
+	zlibCodecID:     "zlib",
+	snappyCodecID:   "snappy",
+	zlibDictCodecID: "zlib-dict",
+	seekableCodecID: "seekable",
+}
+
+// Stat describes the value of key: where it is stored, how, and how big it
+// is on disk and decompressed. Finding the latter may mean decompressing
+// the value.
+func (d *Diskv) Stat(key string) (*ValueInfo, error) {
+	h, err := d.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+
+	fi, err := h.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size, err := h.Size()
+	if err != nil {
+		return nil, err
+	}
+	codec, err := d.codecName(h.f, key)
+	if err != nil {
+		return nil, err
+	}
+	return &ValueInfo{
+		Key:        key,
+		Path:       h.f.Name(),
+		Codec:      codec,
+		StoredSize: fi.Size(),
+		Size:       size,
+		ModTime:    fi.ModTime(),
+	}, nil
+}
+
+func (d *Diskv) codecName(f File, key string) (string, error) {
+	hdr := make([]byte, len(codecMagic)+1)
+	n, err := f.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	d.mu.RLock()
+	legacy := d.compressionFor(key)
+	d.mu.RUnlock()
+
+	c, _, err := valueCodec(hdr[:n], legacy)
+	switch c := c.(type) {
+	case nil:
+		if err != nil {
+			return "", err
+		}
+		return "raw", nil
+	case Codec:
+		if name, ok := codecNames[c.CodecID()]; ok {
+			return name, nil
+		}
+		return fmt.Sprintf("codec %d", c.CodecID()), nil
+	}
+	return "legacy", nil
+}
@@ -0,0 +1,18 @@
+package studydiskv
+
+import "io"
+
+// Store is what code needs to work with a Diskv or anything standing in
+// for one, such as a Client of a remote store.
+type Store interface {
+	Read(key string) ([]byte, error)
+	ReadStream(key string, direct bool) (io.ReadCloser, error)
+	Write(key string, val []byte) error
+	WriteStream(key string, r io.Reader, sync bool) error
+	Erase(key string) error
+	Has(key string) bool
+	Keys(cancel <-chan struct{}) <-chan string
+	KeysPrefix(prefix string, cancel <-chan struct{}) <-chan string
+}
+
+var _ Store = (*Diskv)(nil)
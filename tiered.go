@@ -0,0 +1,409 @@
+package studydiskv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errNoTiers = errors.New("no tiers")
+
+// Tier is one level of a Tiered store.
+type Tier struct {
+	Store *Diskv
+	// MaxSize is how many stored bytes the tier may hold before its least
+	// recently used keys are demoted to the next tier. 0 means no limit.
+	MaxSize int64
+	// MaxIdle is how long a key may go unused before it is demoted to the
+	// next tier. 0 means keys are not demoted for being idle.
+	MaxIdle time.Duration
+}
+
+// Tiered presents several Diskvs, fastest first, as a single store. Writes
+// go to the first tier; keys falling cold are demoted down the tiers, and
+// keys read from a lower tier are promoted back to the first. A memory tier
+// is a Diskv on NewMemFS.
+//
+// Access times are kept in memory. Keys not used since the Tiered was made
+// are taken to have been last used when last written.
+type Tiered struct {
+	tiers   []Tier
+	stop    chan struct{}
+	done    chan struct{}
+	closing sync.Once
+
+	mu  sync.Mutex // held while moving keys between tiers
+	err error
+
+	amu   sync.Mutex // guards atime alone, so reads never wait on moves
+	atime map[string]time.Time
+}
+
+var _ Store = (*Tiered)(nil)
+
+// NewTiered composes tiers into a single store. With a non-zero interval
+// cold keys are demoted in the background that often; otherwise only when
+// Demote is called.
+func NewTiered(tiers []Tier, interval time.Duration) (*Tiered, error) {
+	if len(tiers) == 0 {
+		return nil, errNoTiers
+	}
+	for i, a := range tiers {
+		for _, b := range tiers[i+1:] {
+			if a.Store == b.Store || a.Store.BasePath == b.Store.BasePath {
+				return nil, fmt.Errorf("tier %s used twice", a.Store.BasePath)
+			}
+		}
+	}
+
+	t := &Tiered{tiers: tiers, atime: map[string]time.Time{}}
+	if interval > 0 {
+		t.stop = make(chan struct{})
+		t.done = make(chan struct{})
+		go t.run(interval)
+	}
+	return t, nil
+}
+
+// Err returns the first error met while demoting in the background.
+func (t *Tiered) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Close stops demoting in the background and returns the first error met
+// doing so.
+func (t *Tiered) Close() error {
+	if t.stop != nil {
+		t.closing.Do(func() { close(t.stop) })
+		<-t.done
+	}
+	return t.Err()
+}
+
+func (t *Tiered) run(interval time.Duration) {
+	defer close(t.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.stop:
+			cancel()
+		case <-t.done:
+		}
+	}()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := t.Demote(ctx); err != nil && ctx.Err() == nil {
+			t.mu.Lock()
+			if t.err == nil {
+				t.err = err
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+// TierOf returns the index of the tier holding key, or -1 if none does.
+func (t *Tiered) TierOf(key string) int {
+	for i, tier := range t.tiers {
+		if tier.Store.Has(key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *Tiered) Read(key string) ([]byte, error) {
+	rc, err := t.ReadStream(key, false)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// ReadStream reads key from the first tier holding it, promoting it to the
+// first tier if it was found lower down.
+func (t *Tiered) ReadStream(key string, direct bool) (io.ReadCloser, error) {
+	top := t.tiers[0].Store
+	rc, err := top.ReadStream(key, direct)
+	if err == nil {
+		t.touch(key)
+	}
+	if !os.IsNotExist(err) {
+		return rc, err
+	}
+	for i := 1; i < len(t.tiers); i++ {
+		ok, err := t.promote(key, i)
+		if err != nil {
+			return nil, fmt.Errorf("promote %s: %s", key, err)
+		}
+		if ok {
+			t.touch(key)
+			return top.ReadStream(key, direct)
+		}
+	}
+	return nil, err
+}
+
+// promote moves key from tier i to the first tier, reporting whether tier
+// i had it.
+func (t *Tiered) promote(key string, i int) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tiers[0].Store.Has(key) {
+		return true, nil // promoted or written meanwhile
+	}
+	return t.moveWithLock(key, t.tiers[i].Store, t.tiers[0].Store)
+}
+
+// moveWithLock copies key from src to dst, then erases it from src. Readers
+// search the tiers top down, so while a key is copied down they find it in
+// src, and once it is erased from src they find it in dst.
+func (t *Tiered) moveWithLock(key string, src, dst *Diskv) (bool, error) {
+	ok, err := copyValue(src, dst, key)
+	if !ok || err != nil {
+		return ok, err
+	}
+	if err := src.Erase(key); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+func (t *Tiered) Write(key string, val []byte) error {
+	return t.WriteStream(key, bytes.NewReader(val), false)
+}
+
+// WriteStream writes key to the first tier and erases any older copy of it
+// from the tiers below.
+func (t *Tiered) WriteStream(key string, r io.Reader, sync bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.tiers[0].Store.WriteStream(key, r, sync); err != nil {
+		return err
+	}
+	t.touch(key)
+	return t.eraseBelowWithLock(key, 1)
+}
+
+func (t *Tiered) eraseBelowWithLock(key string, from int) error {
+	for _, tier := range t.tiers[from:] {
+		if err := tier.Store.Erase(key); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Erase removes key from every tier.
+func (t *Tiered) Erase(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.amu.Lock()
+	delete(t.atime, key)
+	t.amu.Unlock()
+	found := false
+	for _, tier := range t.tiers {
+		err := tier.Store.Erase(key)
+		if err == nil {
+			found = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !found {
+		return &os.PathError{Op: "erase", Path: key, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (t *Tiered) Has(key string) bool {
+	return t.TierOf(key) >= 0
+}
+
+func (t *Tiered) Keys(cancel <-chan struct{}) <-chan string {
+	return t.KeysPrefix("", cancel)
+}
+
+func (t *Tiered) KeysPrefix(prefix string, cancel <-chan struct{}) <-chan string {
+	return keysChan(t.KeysSeq(prefix), cancel)
+}
+
+// KeysSeq yields every key beginning with prefix, in lexical order, once
+// however many tiers hold it.
+func (t *Tiered) KeysSeq(prefix string) iter.Seq2[string, error] {
+	seqs := make([]iter.Seq2[string, error], len(t.tiers))
+	for i, tier := range t.tiers {
+		seqs[i] = tier.Store.walkKeys(prefix)
+	}
+	return mergeKeys(seqs)
+}
+
+// touch records key as used now.
+func (t *Tiered) touch(key string) {
+	t.amu.Lock()
+	t.atime[key] = time.Now()
+	t.amu.Unlock()
+}
+
+// accessed returns when key was last used, if it has been since the
+// Tiered was made.
+func (t *Tiered) accessed(key string) (time.Time, bool) {
+	t.amu.Lock()
+	defer t.amu.Unlock()
+	at, ok := t.atime[key]
+	return at, ok
+}
+
+// Demote moves keys idle longer than their tier's MaxIdle to the next
+// tier, then, least recently used first, as many more as it takes to bring
+// each tier within its MaxSize. The last tier keeps whatever it is given.
+func (t *Tiered) Demote(ctx context.Context) error {
+	for i := 0; i < len(t.tiers)-1; i++ {
+		if err := t.demoteTier(ctx, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type tieredKey struct {
+	key   string
+	size  int64
+	atime time.Time
+}
+
+func (t *Tiered) demoteTier(ctx context.Context, i int) error {
+	tier := t.tiers[i]
+	src, dst := tier.Store, t.tiers[i+1].Store
+
+	keys, size, err := t.usage(src)
+	if err != nil {
+		return err
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a].atime.Before(keys[b].atime) })
+
+	now := time.Now()
+	for _, k := range keys {
+		idle := tier.MaxIdle > 0 && now.Sub(k.atime) > tier.MaxIdle
+		full := tier.MaxSize > 0 && size > tier.MaxSize
+		if !idle && !full {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		t.mu.Lock()
+		// Leave keys that have been used since they were listed.
+		moved := false
+		if at, ok := t.accessed(k.key); !ok || !at.After(k.atime) {
+			moved, err = t.moveWithLock(k.key, src, dst)
+		}
+		t.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("demote %s: %s", k.key, err)
+		}
+		if moved {
+			size -= k.size
+		}
+	}
+	return nil
+}
+
+// usage lists the keys in d with their stored sizes and access times, and
+// returns their total size.
+func (t *Tiered) usage(d *Diskv) ([]tieredKey, int64, error) {
+	var keys []tieredKey
+	var total int64
+	for key, err := range d.walkKeys("") {
+		if err != nil {
+			return nil, 0, err
+		}
+		fi, err := d.FileSystem.Stat(d.completeFilename(d.transform(key)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		at, ok := t.accessed(key)
+		if !ok {
+			at = fi.ModTime()
+		}
+		keys = append(keys, tieredKey{key: key, size: fi.Size(), atime: at})
+		total += fi.Size()
+	}
+	return keys, total, nil
+}
+
+// mergeKeys merges sequences of keys, each in lexical order, into one,
+// yielding keys found in several sequences once.
+func mergeKeys(seqs []iter.Seq2[string, error]) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		type cursor struct {
+			next func() (string, error, bool)
+			key  string
+			ok   bool
+		}
+		advance := func(c *cursor) error {
+			var err error
+			c.key, err, c.ok = c.next()
+			return err
+		}
+
+		cursors := make([]*cursor, len(seqs))
+		for i, seq := range seqs {
+			next, stop := iter.Pull2(seq)
+			defer stop()
+			cursors[i] = &cursor{next: next}
+			if err := advance(cursors[i]); err != nil {
+				yield("", err)
+				return
+			}
+		}
+
+		for {
+			var first *cursor
+			for _, c := range cursors {
+				if c.ok && (first == nil || c.key < first.key) {
+					first = c
+				}
+			}
+			if first == nil {
+				return
+			}
+			key := first.key
+			if !yield(key, nil) {
+				return
+			}
+			for _, c := range cursors {
+				if c.ok && c.key == key {
+					if err := advance(c); err != nil {
+						yield("", err)
+						return
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package studydiskv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestTiers(t *testing.T, maxSize int64, maxIdle time.Duration) []Tier {
+	mem := New(Options{BasePath: "test-tiered-mem", FileSystem: NewMemFS()})
+	fast := New(Options{BasePath: "test-tiered-fast"})
+	slow := New(Options{BasePath: "test-tiered-slow", Compression: NewGzipCompression()})
+	t.Cleanup(func() {
+		fast.EraseAll()
+		slow.EraseAll()
+	})
+	return []Tier{
+		{Store: mem, MaxSize: maxSize, MaxIdle: maxIdle},
+		{Store: fast, MaxSize: maxSize, MaxIdle: maxIdle},
+		{Store: slow},
+	}
+}
+
+func TestTieredReadWrite(t *testing.T) {
+	tiers := newTestTiers(t, 0, 0)
+	ts, err := NewTiered(tiers, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	tiers[2].Store.WriteString("k", "stale")
+	tiers[2].Store.WriteString("cold", "value")
+	if err := ts.Write("k", []byte("fresh")); err != nil {
+		t.Fatal(err)
+	}
+	if n := ts.TierOf("k"); n != 0 {
+		t.Errorf("written to tier %d", n)
+	}
+	if tiers[2].Store.Has("k") {
+		t.Errorf("stale copy left in lower tier")
+	}
+
+	val, err := ts.Read("cold")
+	if err != nil || string(val) != "value" {
+		t.Fatalf("cold: have %q, %v", val, err)
+	}
+	if n := ts.TierOf("cold"); n != 0 {
+		t.Errorf("read promoted to tier %d", n)
+	}
+
+	tiers[1].Store.WriteString("dup", "x")
+	tiers[2].Store.WriteString("dup", "y")
+	if keys := collectKeys(t, ts, ""); !cmpStrings(keys, []string{"cold", "dup", "k"}) {
+		t.Errorf("keys: have %v", keys)
+	}
+
+	if err := ts.Erase("dup"); err != nil {
+		t.Fatal(err)
+	}
+	if ts.Has("dup") {
+		t.Errorf("dup left after erase")
+	}
+	if err := ts.Erase("dup"); !os.IsNotExist(err) {
+		t.Errorf("erase missing key: %v", err)
+	}
+	if _, err := ts.Read("dup"); !os.IsNotExist(err) {
+		t.Errorf("read missing key: %v", err)
+	}
+	if _, ok := ts.accessed("dup"); ok {
+		t.Errorf("access time kept for missing key")
+	}
+
+	// Reads from the first tier do not wait on keys being moved.
+	ts.mu.Lock()
+	read := make(chan error)
+	go func() {
+		_, err := ts.Read("k")
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("read waited on a move")
+		defer func() { <-read }()
+	}
+	ts.mu.Unlock()
+
+	if _, err := NewTiered(nil, 0); err != errNoTiers {
+		t.Errorf("want %v, have %v", errNoTiers, err)
+	}
+	if _, err := NewTiered([]Tier{tiers[0], tiers[0]}, 0); err == nil {
+		t.Errorf("tier used twice accepted")
+	}
+}
+
+func TestTieredDemoteSize(t *testing.T) {
+	val := bytes.Repeat([]byte("x"), 1000)
+	ts, err := NewTiered(newTestTiers(t, 3*int64(len(val))+100, 0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	// Write k0..k7, then use them in reverse, so that k7 is coldest.
+	for i := 0; i < 8; i++ {
+		ts.Write(fmt.Sprintf("k%d", i), val)
+	}
+	for i := 7; i >= 0; i-- {
+		ts.Read(fmt.Sprintf("k%d", i))
+		time.Sleep(time.Millisecond)
+	}
+	if err := ts.Demote(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []int{0, 0, 0, 1, 1, 1, 2, 2} {
+		key := fmt.Sprintf("k%d", i)
+		if have := ts.TierOf(key); have != want {
+			t.Errorf("%s: want tier %d, have %d", key, want, have)
+		}
+		if have, err := ts.Read(key); err != nil || !bytes.Equal(have, val) {
+			t.Errorf("%s: have %.10q, %v", key, have, err)
+		}
+	}
+}
+
+func TestTieredDemoteIdle(t *testing.T) {
+	ts, err := NewTiered(newTestTiers(t, 0, 20*time.Millisecond), 5*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Write("idle", []byte("v"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ts.TierOf("idle") != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("not demoted: in tier %d", ts.TierOf("idle"))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := ts.Read("idle"); err != nil || string(val) != "v" {
+		t.Errorf("have %q, %v", val, err)
+	}
+	if n := ts.TierOf("idle"); n != 0 {
+		t.Errorf("read promoted to tier %d", n)
+	}
+}